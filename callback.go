@@ -0,0 +1,192 @@
+package sshw
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"regexp"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/atrox/homedir"
+	"github.com/pkg/errors"
+)
+
+const maxExpectBuffer = 64 * 1024
+
+var (
+	ansiEscape = regexp.MustCompile(`\x1b\[[0-9;?]*[a-zA-Z]|\x1b\][^\x07]*\x07`)
+	// the start of an escape sequence at the end of a write, its rest follows
+	ansiPartial = regexp.MustCompile(`\x1b(\[[0-9;?]*|\][^\x07]*)?$`)
+)
+
+const maxPartialEscape = 256
+
+// runCallbackShells sends the node's callback shells to w, waiting for their
+// expected prompt in output first.
+func (c *defaultClient) runCallbackShells(w io.Writer, output *expectBuffer) error {
+	for i := range c.node.CallbackShells {
+		shell := c.node.CallbackShells[i]
+		time.Sleep(shell.Delay * time.Millisecond)
+
+		if shell.Expect != "" {
+			re, err := regexp.Compile(shell.Expect)
+			if err != nil {
+				return errors.Wrapf(err, "callback shell %d: invalid expect", i+1)
+			}
+
+			err = output.expect(re, shell.timeout())
+			if err != nil {
+				switch shell.OnTimeout {
+				case "skip":
+					continue
+				case "send":
+				default:
+					return errors.Wrapf(err, "callback shell %d", i+1)
+				}
+			}
+		}
+
+		cmd := shell.Cmd
+		if shell.Secret != "" {
+			secret, err := resolveSecret(shell.Secret)
+			if err != nil {
+				return errors.Wrapf(err, "callback shell %d", i+1)
+			}
+			cmd = secret
+		}
+
+		_, err := w.Write([]byte(cmd + "\r"))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// resolveSecret reads a value from env:NAME, file:PATH or cmd:COMMAND.
+func resolveSecret(src string) (string, error) {
+	kind, value, _ := strings.Cut(src, ":")
+
+	switch kind {
+	case "env":
+		v, ok := os.LookupEnv(value)
+		if !ok {
+			return "", errors.Errorf("secret env %s not set", value)
+		}
+		return v, nil
+
+	case "file":
+		p, err := homedir.Expand(value)
+		if err != nil {
+			return "", err
+		}
+		b, err := ioutil.ReadFile(p)
+		if err != nil {
+			return "", errors.Wrap(err, "read secret file fail")
+		}
+		return strings.TrimRight(string(b), "\r\n"), nil
+
+	case "cmd":
+		cmd := shellCommand(value)
+		cmd.Stderr = os.Stderr
+		b, err := cmd.Output()
+		if err != nil {
+			return "", errors.Wrap(err, "run secret cmd fail")
+		}
+		return strings.TrimRight(string(b), "\r\n"), nil
+	}
+
+	return "", errors.Errorf("unknown secret source : %s", src)
+}
+
+// expectBuffer keeps the recent session output, with terminal escape
+// sequences stripped, for callback shells to match prompts against.
+type expectBuffer struct {
+	mu      sync.Mutex
+	buf     []byte
+	partial []byte
+	stopped bool
+	notify  chan struct{}
+}
+
+func newExpectBuffer() *expectBuffer {
+	return &expectBuffer{
+		notify: make(chan struct{}, 1),
+	}
+}
+
+func (b *expectBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.stopped {
+		return len(p), nil
+	}
+
+	data := append(b.partial, p...)
+	b.partial = nil
+	if loc := ansiPartial.FindIndex(data); loc != nil && len(data)-loc[0] <= maxPartialEscape {
+		b.partial = append([]byte(nil), data[loc[0]:]...)
+		data = data[:loc[0]]
+	}
+
+	b.buf = append(b.buf, ansiEscape.ReplaceAll(data, nil)...)
+	if len(b.buf) > maxExpectBuffer {
+		b.buf = b.buf[len(b.buf)-maxExpectBuffer:]
+	}
+
+	select {
+	case b.notify <- struct{}{}:
+	default:
+	}
+
+	return len(p), nil
+}
+
+// expect waits until re matches the buffered output and discards the output
+// up to the end of the match.
+func (b *expectBuffer) expect(re *regexp.Regexp, timeout time.Duration) error {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		b.mu.Lock()
+		loc := re.FindIndex(b.buf)
+		if loc != nil {
+			b.buf = b.buf[loc[1]:]
+		}
+		b.mu.Unlock()
+
+		if loc != nil {
+			return nil
+		}
+
+		select {
+		case <-b.notify:
+		case <-timer.C:
+			return errors.Errorf("timeout waiting for %q after %s", re.String(), timeout)
+		}
+	}
+}
+
+// stop drops the buffer once all callback shells have been sent.
+func (b *expectBuffer) stop() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.stopped = true
+	b.buf, b.partial = nil, nil
+}
+
+// shellCommand runs command with the shell of the platform.
+func shellCommand(command string) *exec.Cmd {
+	if runtime.GOOS == "windows" {
+		return exec.Command("cmd", "/C", command)
+	}
+	return exec.Command("sh", "-c", command)
+}
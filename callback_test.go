@@ -0,0 +1,149 @@
+package sshw
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestExpectBuffer(t *testing.T) {
+	b := newExpectBuffer()
+
+	go func() {
+		time.Sleep(time.Millisecond * 10)
+		b.Write([]byte("Last login: today\r\n\x1b[32mselect\x1b[0m [1-3]: "))
+	}()
+
+	err := b.expect(regexp.MustCompile(`select \[1-3\]: $`), time.Second)
+	assert.Nil(t, err)
+
+	err = b.expect(regexp.MustCompile(`select`), time.Millisecond*10)
+	assert.NotNil(t, err)
+}
+
+func TestExpectBufferSplitEscape(t *testing.T) {
+	b := newExpectBuffer()
+
+	// the escape sequences arrive in pieces
+	b.Write([]byte("\x1b[1"))
+	b.Write([]byte(";32mpass\x1b"))
+	b.Write([]byte("[0m: \x1b]0;title"))
+	b.Write([]byte("\x07"))
+
+	err := b.expect(regexp.MustCompile(`^pass: $`), time.Millisecond*10)
+	assert.Nil(t, err)
+}
+
+func TestRunCallbackShells(t *testing.T) {
+	var (
+		mu    sync.Mutex
+		lines []string
+	)
+
+	// a shell asking for a password and then showing a prompt, it writes its
+	// escape sequences split over several writes
+	node := newTestServerFunc(t, func(conn net.Conn, config *ssh.ServerConfig) {
+		sconn, chans, reqs, err := ssh.NewServerConn(conn, config)
+		if err != nil {
+			conn.Close()
+			return
+		}
+		defer sconn.Close()
+		go ssh.DiscardRequests(reqs)
+
+		for nc := range chans {
+			ch, chReqs, err := nc.Accept()
+			if err != nil {
+				continue
+			}
+			go func() {
+				for req := range chReqs {
+					req.Reply(req.Type == "shell", nil)
+					if req.Type != "shell" {
+						continue
+					}
+
+					go func() {
+						defer ch.Close()
+						ch.Write([]byte("\x1b[1"))
+						ch.Write([]byte("mpassword\x1b[0m: "))
+						r := bufio.NewReader(ch)
+						for {
+							line, err := r.ReadString('\r')
+							if err != nil {
+								return
+							}
+							line = strings.TrimSuffix(line, "\r")
+							mu.Lock()
+							lines = append(lines, line)
+							mu.Unlock()
+							if line == "exit" {
+								return
+							}
+							ch.Write([]byte("\x1b[32mhost\x1b"))
+							ch.Write([]byte("[0m $ "))
+						}
+					}()
+				}
+			}()
+		}
+	})
+
+	t.Setenv("SSHW_TEST_SECRET", "123456")
+	node.CallbackShells = []*CallbackShell{
+		{Expect: `password: $`, Secret: "env:SSHW_TEST_SECRET"},
+		{Expect: `never`, Timeout: 50, OnTimeout: "skip", Cmd: "skipped"},
+		{Expect: `never`, Timeout: 50, OnTimeout: "send", Cmd: "sent"},
+		{Expect: `host \$ $`, Cmd: "exit"},
+	}
+
+	c := genSSHConfig(node)
+	assert.Nil(t, c.connect(context.Background()))
+	defer c.Close()
+
+	s, err := c.client.NewSession()
+	assert.Nil(t, err)
+	defer s.Close()
+
+	output := newExpectBuffer()
+	defer output.stop()
+	s.Stdout = output
+	w, err := s.StdinPipe()
+	assert.Nil(t, err)
+	assert.Nil(t, s.Shell())
+
+	assert.Nil(t, c.runCallbackShells(w, output))
+	s.Wait()
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, []string{"123456", "sent", "exit"}, lines)
+
+	// a prompt that never shows up fails by default
+	node.CallbackShells = []*CallbackShell{{Expect: `never`, Timeout: 10, Cmd: "ls"}}
+	assert.NotNil(t, c.runCallbackShells(w, newExpectBuffer()))
+}
+
+func TestResolveSecret(t *testing.T) {
+	os.Setenv("SSHW_TEST_SECRET", "123456")
+	defer os.Unsetenv("SSHW_TEST_SECRET")
+
+	v, err := resolveSecret("env:SSHW_TEST_SECRET")
+	assert.Nil(t, err)
+	assert.Equal(t, "123456", v)
+
+	_, err = resolveSecret("env:SSHW_TEST_SECRET_MISSING")
+	assert.NotNil(t, err)
+
+	_, err = resolveSecret("123456")
+	assert.NotNil(t, err)
+}
@@ -8,16 +8,18 @@ import (
 	"io/ioutil"
 	"net"
 	"os"
-	"os/user"
 	"path"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
+	"github.com/atrox/homedir"
 	"github.com/pkg/errors"
 	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
 	"golang.org/x/crypto/ssh/terminal"
 )
 
@@ -40,32 +42,69 @@ var (
 	}
 )
 
+const (
+	resizeDebounce = time.Millisecond * 50
+	cleanupTimeout = time.Second * 5
+)
+
+// Client connects to a node. Login and Scp open and close their own
+// connection, unless Connect was called before, then they reuse it and the
+// caller closes it.
 type Client interface {
-	Login()
-	Scp(ScpOption)
+	Login(ctx context.Context) error
+	Scp(ctx context.Context, opt ScpOption) error
+	// ScpAll copies the files of opts over up to parallel sessions of one
+	// connection at once, with one progress for all. The files share one
+	// bandwidth, so their limits must be the same.
+	ScpAll(ctx context.Context, opts []ScpOption, parallel int) error
+	// Exec runs cmd with the standard streams of sshw.
+	Exec(ctx context.Context, cmd string) error
+	// Forward forwards ports until ctx is done or the connection is lost.
+	Forward(ctx context.Context, forwards ...Forward) error
+
+	// Connect connects to the node, so that SSHClient can be used.
+	Connect(ctx context.Context) error
+	// SSHClient returns the underlying connection, nil before Connect.
+	SSHClient() *ssh.Client
+	Close() error
 }
 
 type defaultClient struct {
 	clientConfig *ssh.ClientConfig
 	node         *Node
 	client       *ssh.Client
+
+	// answers caches keyboard interactive answers by question, so reconnects don't prompt again
+	answers      map[string]string
+	reconnecting bool
+	jump         *defaultClient
+	jumpClient   *ssh.Client
+	recorder     *Recorder
+	modes        ssh.TerminalModes
+	hostKeyErr   error
+	// hostKeyOK is set once the host key was accepted, a handshake failing
+	// after it failed in authentication
+	hostKeyOK bool
+
+	// the compression auto detected for the host
+	autoCodec   *codec
+	codecProbed bool
 }
 
 func genSSHConfig(node *Node) *defaultClient {
-	u, err := user.Current()
-	if err != nil {
-		l.Error(err)
-		return nil
+	c := &defaultClient{
+		node:    node,
+		answers: make(map[string]string),
 	}
 
 	var authMethods []ssh.AuthMethod
 
-	var pemBytes []byte
-	if node.KeyPath == "" {
-		pemBytes, err = ioutil.ReadFile(path.Join(u.HomeDir, ".ssh/id_rsa"))
-	} else {
-		pemBytes, err = ioutil.ReadFile(node.KeyPath)
+	keyPath, err := node.keyPath()
+	if err != nil {
+		l.Error(err)
 	}
+
+	pemBytes, err := ioutil.ReadFile(keyPath)
 	if err != nil {
 		l.Error(err)
 	} else {
@@ -89,7 +128,20 @@ func genSSHConfig(node *Node) *defaultClient {
 	}
 
 	authMethods = append(authMethods, ssh.KeyboardInteractive(func(user, instruction string, questions []string, echos []bool) ([]string, error) {
+		if c.reconnecting {
+			// stdin is read by the session relay meanwhile, there is no one to ask
+			if answers, ok := c.cachedAnswers(questions); ok {
+				return answers, nil
+			}
+			return nil, errors.New("no cached answers to reconnect with")
+		}
+
 		answers := make([]string, 0, len(questions))
+		defer func() {
+			for i := range answers {
+				c.answers[questions[i]] = answers[i]
+			}
+		}()
 		for i, q := range questions {
 			fmt.Print(q)
 			if echos[i] {
@@ -116,198 +168,653 @@ func genSSHConfig(node *Node) *defaultClient {
 	config := &ssh.ClientConfig{
 		User:            node.user(),
 		Auth:            authMethods,
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		HostKeyCallback: c.hostKeyCallback,
 		Timeout:         time.Second * 10,
 	}
 
 	config.SetDefaults()
 	config.Ciphers = append(config.Ciphers, DefaultCiphers...)
 
-	return &defaultClient{
-		clientConfig: config,
-		node:         node,
-	}
+	c.clientConfig = config
+
+	return c
 }
 
 func NewClient(node *Node) Client {
 	return genSSHConfig(node)
 }
 
-func (c *defaultClient) Scp(opt ScpOption) {
-	err := c.connect()
+// hostKeyCallback checks the host key against the node's known hosts file, any
+// key is accepted when it is not configured.
+func (c *defaultClient) hostKeyCallback(hostname string, remote net.Addr, key ssh.PublicKey) error {
+	c.hostKeyErr, c.hostKeyOK = nil, false
+	if c.node.KnownHosts == "" {
+		c.hostKeyOK = true
+		return nil
+	}
+
+	p, err := homedir.Expand(c.node.KnownHosts)
 	if err != nil {
-		l.Error(err)
+		return err
 	}
-	defer c.Close()
 
-	err = opt.Valid()
+	cb, err := knownhosts.New(p)
 	if err != nil {
-		l.Error(err)
-		os.Exit(1)
-		return
+		return errors.Wrap(err, "load known hosts fail")
+	}
+
+	c.hostKeyErr = cb(hostname, remote, key)
+	c.hostKeyOK = c.hostKeyErr == nil
+	return c.hostKeyErr
+}
+
+func (c *defaultClient) Scp(ctx context.Context, opt ScpOption) error {
+	return c.ScpAll(ctx, []ScpOption{opt}, 1)
+}
+
+func (c *defaultClient) ScpAll(ctx context.Context, opts []ScpOption, parallel int) error {
+	if len(opts) == 0 {
+		return nil
+	}
+
+	opts = append([]ScpOption(nil), opts...)
+	for i := range opts {
+		err := opts[i].Valid()
+		if err != nil {
+			return err
+		}
+		if opts[i].Limit != opts[0].Limit {
+			return errors.New("the files of ScpAll must have the same limit")
+		}
+	}
+
+	limit := opts[0].Limit
+	if limit == 0 && c.node.Limit != "" {
+		var err error
+		limit, err = ParseRate(c.node.Limit)
+		if err != nil {
+			return errors.Wrap(err, "parse limit fail")
+		}
 	}
 
+	if c.client == nil {
+		err := c.connect(ctx)
+		if err != nil {
+			return err
+		}
+		defer c.Close()
+	}
+
+	cd, err := c.codec()
+	if err != nil {
+		return err
+	}
+
+	if len(opts) == 1 {
+		opts[0].Limit = limit
+		return c.copyFile(ctx, cd, opts[0])
+	}
+
+	// one progress for all, and the bandwidth is for all of them together
+	p := newProgress(os.Stdout)
+	limiter := newRateLimiter(limit)
+	if parallel < 1 {
+		parallel = 1
+	}
+
+	errs := make([]error, len(opts))
+	sem := make(chan struct{}, parallel)
+	var wg sync.WaitGroup
+	for i := range opts {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+
+		opt := opts[i]
+		opt.progress, opt.limiter = p, limiter
+		wg.Add(1)
+		go func(i int) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			errs[i] = c.copyFile(ctx, cd, opt)
+		}(i)
+	}
+	wg.Wait()
+	p.close()
+
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	var failed int
+	for i, err := range errs {
+		if err != nil {
+			failed++
+			l.Errorf("copy %s fail : %s", opts[i].SrcFilePath, err)
+		}
+	}
+	if failed > 0 {
+		return errors.Errorf("copy %d of %d files fail", failed, len(opts))
+	}
+	return nil
+}
+
+// copyFile copies a file over a session of its own, compressed with cd unless it is nil.
+func (c *defaultClient) copyFile(ctx context.Context, cd *codec, opt ScpOption) error {
 	session, err := c.client.NewSession()
 	if err != nil {
-		l.Error(err)
-		os.Exit(1)
-		return
+		return errors.Wrap(err, "new session fail")
+	}
+	defer session.Close()
+
+	if opt.SrcHost != "" {
+		if cd != nil {
+			err = streamFromRemote(ctx, session, cd, opt.SrcFilePath, opt.TarFilePath, opt.CopyOption)
+		} else {
+			err = CopyFromRemote(ctx, session, opt.SrcFilePath, opt.TarFilePath, opt.CopyOption)
+		}
+		if err != nil || !opt.Verify {
+			return err
+		}
+		return c.verify(opt.TarFilePath, opt.SrcFilePath)
 	}
 
-	if opt.SrcHost == "" {
-		err = CopyFromLocal(context.Background(), session, opt.SrcFilePath, opt.TarFilePath)
+	if cd != nil {
+		err = streamFromLocal(ctx, session, cd, opt.SrcFilePath, opt.TarFilePath, opt.CopyOption)
 	} else {
-		err = CopyFromRemote(context.Background(), session, opt.SrcFilePath, opt.TarFilePath)
+		err = CopyFromLocal(ctx, session, opt.SrcFilePath, opt.TarFilePath, opt.CopyOption)
 	}
+	if err != nil && ctx.Err() != nil {
+		if cd != nil {
+			// the target itself is only replaced once the stream is complete
+			c.runQuiet(partFile(opt.TarFilePath) + `; rm -f "$t"`)
+		} else {
+			c.removeRemote(opt.TarFilePath)
+		}
+	}
+	if err != nil || !opt.Verify {
+		return err
+	}
+	return c.verify(opt.SrcFilePath, opt.TarFilePath)
+}
 
+// verify compares the sha256 of the local file with the one of the remote file.
+func (c *defaultClient) verify(local, remote string) error {
+	want, err := fileSha256(local)
 	if err != nil {
-		l.Error(err)
-		os.Exit(1)
-		return
+		return err
+	}
+
+	session, err := c.client.NewSession()
+	if err != nil {
+		return errors.Wrap(err, "new session fail")
+	}
+	defer session.Close()
+
+	// systems without sha256sum have shasum or openssl
+	cmd := remoteTarget(remote) + `; sha256sum "$p" || shasum -a 256 "$p" || openssl dgst -sha256 -r "$p"`
+	out, err := session.Output(cmd)
+	fields := strings.Fields(string(out))
+	if err != nil || len(fields) == 0 {
+		return errors.Errorf("get sha256 of %s fail : %v", remote, err)
 	}
 
-	fmt.Println("")
-	fmt.Println("✅  copy file success")
-	fmt.Println("")
+	got := strings.ToLower(fields[0])
+	if got != want {
+		return errors.Wrapf(ErrChecksumMismatch, "sha256 of %s is %s, %s is %s", local, want, remote, got)
+	}
+	return nil
 }
 
-func (c *defaultClient) Login() {
-	c.connect()
-	defer c.Close()
+func (c *defaultClient) Exec(ctx context.Context, cmd string) error {
+	if c.client == nil {
+		err := c.connect(ctx)
+		if err != nil {
+			return err
+		}
+		defer c.Close()
+	}
+
+	cd, err := c.codec()
+	if err != nil {
+		return err
+	}
 
 	session, err := c.client.NewSession()
 	if err != nil {
-		l.Error(err)
-		os.Exit(1)
-		return
+		return errors.Wrap(err, "new session fail")
+	}
+	defer session.Close()
+
+	for _, kv := range c.node.env() {
+		session.Setenv(kv[0], kv[1])
+	}
+	session.Stdin = os.Stdin
+	session.Stdout = os.Stdout
+	session.Stderr = os.Stderr
+
+	var stop func() error
+	if cd != nil {
+		// a terminal is typed into, it is not compressed so that each line is sent at once
+		compressStdin := !terminal.IsTerminal(int(os.Stdin.Fd()))
+		cmd = cd.compressCommand(cmd, compressStdin)
+		stop = compressStreams(session, cd, compressStdin)
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			session.Signal(ssh.SIGINT)
+			session.Close()
+		case <-done:
+		}
+	}()
+
+	err = session.Run(cmd)
+	if stop != nil {
+		if serr := stop(); err == nil {
+			err = serr
+		}
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return exitError(c.node.Host, err)
+}
+
+// removeRemote removes a partially uploaded file.
+func (c *defaultClient) removeRemote(p string) {
+	c.runQuiet(remoteTarget(p) + `; test -f "$p" && rm -f "$p"`)
+}
+
+// runQuiet runs cmd on the remote, ignoring its result. It gives up after
+// cleanupTimeout, the connection may be dead already.
+func (c *defaultClient) runQuiet(cmd string) {
+	client := c.client
+	done := make(chan struct{})
+	var session *ssh.Session
+	var mu sync.Mutex
+	go func() {
+		defer close(done)
+		s, err := client.NewSession()
+		if err != nil {
+			return
+		}
+		mu.Lock()
+		session = s
+		mu.Unlock()
+		defer s.Close()
+
+		s.Run(cmd)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(cleanupTimeout):
+		mu.Lock()
+		if session != nil {
+			session.Close()
+		}
+		mu.Unlock()
+	}
+}
+
+// remoteTarget sets p to the file an upload to remote is written to, a
+// directory as target gets the name of the target in it, see CopyFromLocal.
+func remoteTarget(remote string) string {
+	return fmt.Sprintf(`p=%s; [ -d "$p" ] && p="$p"/%s`, shellQuote(remote), shellQuote(path.Base(remote)))
+}
+
+func (c *defaultClient) Login(ctx context.Context) error {
+	if c.client == nil {
+		err := c.connect(ctx)
+		if err != nil {
+			return err
+		}
+		defer c.Close()
 	}
 
 	fd := int(os.Stdin.Fd())
+	c.modes = terminalModes(fd)
 	state, err := terminal.MakeRaw(fd)
 	if err != nil {
-		l.Error(err)
-		return
+		return err
 	}
 	defer terminal.Restore(fd, state)
 
+	if c.node.Record != nil {
+		err = c.startRecord(fd)
+		if err != nil {
+			return err
+		}
+		defer c.recorder.Close()
+	}
+
+	var input io.Writer = io.Discard
+	if c.node.Record != nil && c.node.Record.Input {
+		input = c.recorder.Input()
+	}
+
+	// change stdin to user, and stop reading it once the login ends
+	done := make(chan struct{})
+	copied := make(chan struct{})
+	defer func() {
+		close(done)
+		if stdinInterruptible {
+			<-copied
+		}
+	}()
+
+	stdin := newStdinRelay()
+	go func() {
+		defer close(copied)
+		_, err := io.Copy(io.MultiWriter(stdin, input), newStdinReader(os.Stdin, done))
+		if err != nil {
+			l.Error(err)
+		}
+		stdin.Close()
+	}()
+
+	// a cancelled context ends the session like the end of stdin does
+	go func() {
+		select {
+		case <-ctx.Done():
+			stdin.Close()
+		case <-done:
+		}
+	}()
+
+	for {
+		err = c.shell(fd, stdin)
+		if c.node.Reconnect == nil || stdin.closed() || !isConnectionLost(err) || !c.connectionDead() {
+			break
+		}
+
+		err = c.reconnect(ctx, stdin)
+		if err != nil {
+			break
+		}
+	}
+
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if stdin.closed() {
+		return nil
+	}
+	return exitError(c.node.Host, err)
+}
+
+func (c *defaultClient) startRecord(fd int) error {
 	w, h, err := terminal.GetSize(fd)
 	if err != nil {
-		l.Error(err)
-		return
+		return err
 	}
 
-	modes := ssh.TerminalModes{
-		ssh.ECHO:          1,
-		ssh.TTY_OP_ISPEED: 14400,
-		ssh.TTY_OP_OSPEED: 14400,
+	p, err := c.node.Record.path(c.node, time.Now())
+	if err != nil {
+		return err
 	}
-	err = session.RequestPty("xterm", h, w, modes)
+
+	c.recorder, err = NewRecorder(p, w, h, c.node.Name)
+	return err
+}
+
+// shell runs an interactive shell on the current connection until it exits.
+func (c *defaultClient) shell(fd int, stdin *stdinRelay) error {
+	session, err := c.client.NewSession()
 	if err != nil {
-		l.Error(err)
-		return
+		return err
 	}
+	defer session.Close()
 
-	session.Stdout = os.Stdout
-	session.Stderr = os.Stderr
+	w, h, err := terminal.GetSize(fd)
+	if err != nil {
+		return err
+	}
+
+	for _, kv := range c.node.env() {
+		// servers only accept variables listed in their AcceptEnv, like openssh the rest are ignored
+		session.Setenv(kv[0], kv[1])
+	}
+
+	err = session.RequestPty(c.node.term(), h, w, c.modes)
+	if err != nil {
+		return err
+	}
+
+	output := newExpectBuffer()
+	session.Stdout = io.MultiWriter(os.Stdout, output, c.recorder.Output())
+	session.Stderr = io.MultiWriter(os.Stderr, c.recorder.Output())
 	stdinPipe, err := session.StdinPipe()
 	if err != nil {
-		l.Error(err)
-		return
+		return err
 	}
 
 	err = session.Shell()
 	if err != nil {
-		l.Error(err)
-		return
+		return err
 	}
 
 	// then callback
-	for i := range c.node.CallbackShells {
-		shell := c.node.CallbackShells[i]
-		time.Sleep(shell.Delay * time.Millisecond)
-		stdinPipe.Write([]byte(shell.Cmd + "\r"))
+	err = c.runCallbackShells(stdinPipe, output)
+	output.stop()
+	if err != nil {
+		return err
 	}
 
-	// change stdin to user
-	go func() {
-		_, err = io.Copy(stdinPipe, os.Stdin)
-		l.Error(err)
-		session.Close()
-	}()
+	if c.node.Reconnect != nil {
+		if cmd := c.node.Reconnect.attachCmd(c.node); cmd != "" {
+			stdinPipe.Write([]byte(cmd + "\r"))
+		}
+	}
 
-	// interval get terminal size
-	// fix resize issue
-	go func() {
-		var (
-			ow = w
-			oh = h
-		)
-		for {
+	stdin.attach(stdinPipe, session)
+	defer stdin.detach()
+
+	done := make(chan struct{})
+	defer close(done)
+
+	go c.resize(done, session, fd, w, h)
+
+	// send keepalive
+	alive := make(chan error, 1)
+	if interval := c.node.serverAliveInterval(); interval > 0 {
+		// the goroutine may outlive the connection, a reconnect replaces c.client
+		client := c.client
+		go func() {
+			alive <- c.keepalive(client, done, interval, c.node.serverAliveCountMax())
+		}()
+	}
+
+	err = session.Wait()
+	select {
+	case aliveErr := <-alive:
+		if aliveErr != nil {
+			return aliveErr
+		}
+	default:
+	}
+	return err
+}
+
+func defaultTerminalModes() ssh.TerminalModes {
+	return ssh.TerminalModes{
+		ssh.ECHO:          1,
+		ssh.TTY_OP_ISPEED: 14400,
+		ssh.TTY_OP_OSPEED: 14400,
+	}
+}
+
+// resize follows the local terminal size until done is closed. Resize events
+// come in bursts while a window is dragged, so they are debounced.
+func (c *defaultClient) resize(done <-chan struct{}, session *ssh.Session, fd, w, h int) {
+	events := watchResize(done)
+
+	debounce := time.NewTimer(resizeDebounce)
+	debounce.Stop()
+	defer debounce.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-events:
+			debounce.Reset(resizeDebounce)
+		case <-debounce.C:
 			cw, ch, err := terminal.GetSize(fd)
 			if err != nil {
-				break
+				return
+			}
+			if cw == w && ch == h {
+				continue
 			}
 
-			if cw != ow || ch != oh {
-				err = session.WindowChange(ch, cw)
-				if err != nil {
-					break
-				}
-				ow = cw
-				oh = ch
+			err = session.WindowChange(ch, cw)
+			if err != nil {
+				return
 			}
-			time.Sleep(time.Second)
+			c.recorder.Resize(cw, ch)
+			w, h = cw, ch
 		}
-	}()
+	}
+}
 
-	// send keepalive
-	go func() {
-		for {
-			time.Sleep(time.Second * 10)
-			c.client.SendRequest("keepalive@openssh.com", false, nil)
+// keepalive sends keepalive@openssh.com requests on client every interval.
+// Once countMax of them went unanswered, it closes the connection so
+// session.Wait returns instead of hanging on a dead link, and returns an error.
+func (c *defaultClient) keepalive(client *ssh.Client, done <-chan struct{}, interval time.Duration, countMax int) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	replies := make(chan error, 1)
+	pending := false
+	missed := 0
+
+	for {
+		select {
+		case <-done:
+			return nil
+		case err := <-replies:
+			if err != nil {
+				// connection is already gone
+				return nil
+			}
+			pending = false
+			missed = 0
+		case <-ticker.C:
+			if pending {
+				missed++
+				if missed >= countMax {
+					client.Close()
+					return &ConnectError{
+						Host: c.node.Host,
+						Kind: ErrHostUnreachable,
+						Err:  errors.Errorf("no reply to %d keepalives", missed),
+					}
+				}
+				continue
+			}
+
+			pending = true
+			go func() {
+				_, _, err := client.SendRequest("keepalive@openssh.com", true, nil)
+				replies <- err
+			}()
 		}
-	}()
+	}
+}
 
-	session.Wait()
+func (c *defaultClient) Connect(ctx context.Context) error {
+	if c.client != nil {
+		return nil
+	}
+	return c.connect(ctx)
+}
+
+func (c *defaultClient) SSHClient() *ssh.Client {
+	return c.client
 }
 
 func (c *defaultClient) Close() error {
-	return c.client.Close()
+	if c.client == nil {
+		return nil
+	}
+
+	if c.jumpClient != nil {
+		c.jumpClient.Close()
+		c.jumpClient = nil
+	}
+	err := c.client.Close()
+	c.client = nil
+	return err
 }
 
-func (c *defaultClient) connect() error {
+func (c *defaultClient) connect(ctx context.Context) error {
+	if c.node.Multiplex {
+		client, err := dialDaemon(ctx, c.node)
+		if err == nil {
+			c.client = client
+			return nil
+		}
+		// fall back to a direct connection, which can also prompt for credentials
+		l.Errorf("use shared connection fail : %s", err)
+	}
+
 	host := c.node.Host
 	port := strconv.Itoa(c.node.port())
+	addr := net.JoinHostPort(host, port)
 	jNodes := c.node.Jump
 
 	var client *ssh.Client
 	var err error
 
+	c.hostKeyErr, c.hostKeyOK = nil, false
 	if len(jNodes) > 0 {
 		jNode := jNodes[0]
-		jc := genSSHConfig(jNode)
-		proxyClient, err := ssh.Dial("tcp", net.JoinHostPort(jNode.Host, strconv.Itoa(jNode.port())), jc.clientConfig)
+		if c.jump == nil {
+			c.jump = genSSHConfig(jNode)
+		}
+		c.jump.hostKeyErr, c.jump.hostKeyOK = nil, false
+		// the proxy is for the first hop
+		proxy := jNode.Proxy
+		if proxy == "" {
+			proxy = c.node.Proxy
+		}
+		hop := jNode
+		if hop.ProxyCommand == "" && c.node.ProxyCommand != "" {
+			n := *jNode
+			n.ProxyCommand = c.node.ProxyCommand
+			hop = &n
+		}
+		proxyClient, err := dialContext(ctx, hop, proxy, c.jump.clientConfig)
 		if err != nil {
-			l.Error(err)
-			return err
+			return c.jump.connectError(jNode.Host, err)
 		}
-		conn, err := proxyClient.Dial("tcp", net.JoinHostPort(host, port))
+		conn, err := proxyDial(ctx, proxyClient, addr)
 		if err != nil {
-			l.Error(err)
-			return err
+			proxyClient.Close()
+			return &ConnectError{Host: host, Kind: ErrHostUnreachable, Err: err}
 		}
-		ncc, chans, reqs, err := ssh.NewClientConn(conn, net.JoinHostPort(host, port), c.clientConfig)
+		client, err = handshake(ctx, conn, addr, c.clientConfig)
 		if err != nil {
-			l.Error(err)
-			return err
+			proxyClient.Close()
+			return c.connectError(host, err)
 		}
-		client = ssh.NewClient(ncc, chans, reqs)
+		c.jumpClient = proxyClient
 	} else {
-		client, err = ssh.Dial("tcp", net.JoinHostPort(host, port), c.clientConfig)
-		if err != nil {
+		client, err = dialContext(ctx, c.node, c.node.Proxy, c.clientConfig)
+		if err != nil && ctx.Err() == nil {
 			msg := err.Error()
-			// use terminal password retry
-			if strings.Contains(msg, "no supported methods remain") && !strings.Contains(msg, "password") {
+			// use terminal password retry, it stays in the config for a reconnect
+			if strings.Contains(msg, "no supported methods remain") && !strings.Contains(msg, "password") && !c.reconnecting {
 				fmt.Printf("%s@%s's password:", c.clientConfig.User, host)
 				var b []byte
 				b, err = terminal.ReadPassword(int(syscall.Stdin))
@@ -316,13 +823,13 @@ func (c *defaultClient) connect() error {
 					if p != "" {
 						c.clientConfig.Auth = append(c.clientConfig.Auth, ssh.Password(p))
 					}
-					client, err = ssh.Dial("tcp", net.JoinHostPort(host, port), c.clientConfig)
+					c.hostKeyErr, c.hostKeyOK = nil, false
+					client, err = dialContext(ctx, c.node, c.node.Proxy, c.clientConfig)
 				}
 			}
 		}
 		if err != nil {
-			l.Error(err)
-			return err
+			return c.connectError(host, err)
 		}
 	}
 
@@ -333,12 +840,93 @@ func (c *defaultClient) connect() error {
 	return nil
 }
 
+// dialContext is ssh.Dial to node through its proxy command or proxy, if any,
+// that gives up when ctx is done.
+func dialContext(ctx context.Context, node *Node, proxy string, config *ssh.ClientConfig) (*ssh.Client, error) {
+	addr := net.JoinHostPort(node.Host, strconv.Itoa(node.port()))
+	var conn net.Conn
+	var err error
+	if node.ProxyCommand != "" {
+		var command string
+		command, err = node.proxyCommand()
+		if err != nil {
+			return nil, err
+		}
+		conn, err = dialCommand(command)
+
+		// the command connects on its own, the timeout is for the handshake
+		if config.Timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, config.Timeout)
+			defer cancel()
+		}
+	} else {
+		conn, err = dialTCP(ctx, proxy, addr, config.Timeout)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return handshake(ctx, conn, addr, config)
+}
+
+// proxyDial dials addr through a jump host, giving up when ctx is done.
+func proxyDial(ctx context.Context, proxy *ssh.Client, addr string) (net.Conn, error) {
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+
+	ch := make(chan result, 1)
+	go func() {
+		conn, err := proxy.Dial("tcp", addr)
+		ch <- result{conn, err}
+	}()
+
+	select {
+	case r := <-ch:
+		return r.conn, r.err
+	case <-ctx.Done():
+		// closing the jump client unblocks the dial
+		proxy.Close()
+		return nil, ctx.Err()
+	}
+}
+
+// handshake runs the ssh handshake over conn, the connection is closed when
+// ctx is done before the handshake finished.
+func handshake(ctx context.Context, conn net.Conn, addr string, config *ssh.ClientConfig) (*ssh.Client, error) {
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-stop:
+		}
+	}()
+
+	ncc, chans, reqs, err := ssh.NewClientConn(conn, addr, config)
+	if err != nil {
+		conn.Close()
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+	return ssh.NewClient(ncc, chans, reqs), nil
+}
+
 type ScpOption struct {
 	SrcFilePath string
 	SrcHost     string
 
 	TarFilePath string
 	TarHost     string
+
+	// Verify compares the sha256 of both sides after the copy.
+	Verify bool
+	// a Limit of 0 takes the one of the node
+	CopyOption
 }
 
 func (o *ScpOption) Valid() error {
@@ -416,17 +1004,84 @@ func ParseScpOption(s string) (ScpOption, error) {
 	return opt, opt.Valid()
 }
 
+// ParseScpOptions parses the sources and the target of scp, a directory when
+// there are several sources. They must all be on the same side, a copy to the
+// remote host or from it.
+func ParseScpOptions(args []string) ([]ScpOption, error) {
+	if len(args) < 3 {
+		opt, err := ParseScpOption("scp " + strings.Join(args, " "))
+		if err != nil {
+			return nil, err
+		}
+		return []ScpOption{opt}, nil
+	}
+
+	host, dir, err := ParseHostFile(args[len(args)-1])
+	if err != nil {
+		return nil, err
+	}
+
+	var opts []ScpOption
+	names := make(map[string]bool)
+	for _, src := range args[:len(args)-1] {
+		_, p, err := ParseHostFile(src)
+		if err != nil {
+			return nil, err
+		}
+		name := path.Base(p)
+		if names[name] {
+			return nil, errors.Errorf("copy two files named %s into %s", name, dir)
+		}
+		names[name] = true
+
+		tar := path.Join(dir, name)
+		if host != "" {
+			tar = host + ":" + tar
+		}
+		opt, err := ParseScpOption("scp " + src + " " + tar)
+		if err != nil {
+			return nil, err
+		}
+		if len(opts) > 0 && (opt.SrcHost != opts[0].SrcHost || opt.TarHost != opts[0].TarHost) {
+			return nil, errors.New("the files must all be copied from or to the same host")
+		}
+		opts = append(opts, opt)
+	}
+	return opts, nil
+}
+
+// ParseHostFile splits [user@]host[:port]:path into the target and the path,
+// the host may be in brackets like [::1]. Without a host, s is a local path.
 func ParseHostFile(s string) (host string, filePath string, err error) {
-	ss := strings.Split(s, ":")
-	if len(ss) == 2 {
-		return ss[0], parseRelativePath(ss[1]), nil
+	if i := strings.Index(s, "["); i >= 0 && i < strings.Index(s+":", ":") {
+		end := strings.Index(s, "]")
+		if end < i || !strings.HasPrefix(s[end+1:], ":") {
+			return "", "", errors.Errorf("parse host fail : %s", s)
+		}
+		host, p := s[:end+1], s[end+2:]
+		if port, rest, ok := cutPort(p); ok {
+			host, p = host+":"+port, rest
+		}
+		return host, parseRelativePath(p), nil
 	}
 
-	if len(ss) == 1 {
-		return "", parseRelativePath(ss[0]), nil
+	host, p, ok := strings.Cut(s, ":")
+	if !ok {
+		return "", parseRelativePath(s), nil
+	}
+	if port, rest, ok := cutPort(p); ok {
+		host, p = host+":"+port, rest
 	}
+	return host, parseRelativePath(p), nil
+}
 
-	return "", "", errors.Errorf("parse host fail : %s", s)
+// cutPort cuts the digits of a port followed by a colon off s.
+func cutPort(s string) (port, rest string, ok bool) {
+	port, rest, ok = strings.Cut(s, ":")
+	if !ok || port == "" || strings.Trim(port, "0123456789") != "" {
+		return "", s, false
+	}
+	return port, rest, true
 }
 
 func parseRelativePath(s string) string {
@@ -441,3 +1096,8 @@ func parseRelativePath(s string) string {
 
 	return "./" + cs
 }
+
+// shellQuote quotes s for a posix shell.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
@@ -0,0 +1,285 @@
+package sshw
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+const testPassword = "sshw"
+
+// newTestServer starts an ssh server accepting testPassword, it runs exec
+// requests with the local sh. It returns a node pointing to the server.
+func newTestServer(t *testing.T) *Node {
+	return newTestServerFunc(t, serveTestConn)
+}
+
+// newTestServerFunc is newTestServer with serve for the connections.
+func newTestServerFunc(t *testing.T, serve func(net.Conn, *ssh.ServerConfig)) *Node {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	assert.Nil(t, err)
+	signer, err := ssh.NewSignerFromKey(key)
+	assert.Nil(t, err)
+
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(c ssh.ConnMetadata, pass []byte) (*ssh.Permissions, error) {
+			if string(pass) == testPassword {
+				return nil, nil
+			}
+			return nil, errors.New("wrong password")
+		},
+	}
+	config.AddHostKey(signer)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go serve(conn, config)
+		}
+	}()
+
+	host, port, _ := net.SplitHostPort(ln.Addr().String())
+	p, _ := strconv.Atoi(port)
+
+	return &Node{
+		Name:     "test",
+		Host:     host,
+		Port:     p,
+		User:     "test",
+		Password: testPassword,
+		KeyPath:  filepath.Join(t.TempDir(), "id_none"),
+	}
+}
+
+func serveTestConn(conn net.Conn, config *ssh.ServerConfig) {
+	sconn, chans, reqs, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	defer sconn.Close()
+
+	go func() {
+		for req := range reqs {
+			if req.WantReply {
+				req.Reply(req.Type == "keepalive@openssh.com", nil)
+			}
+		}
+	}()
+
+	for nc := range chans {
+		switch nc.ChannelType() {
+		case "session":
+			ch, chReqs, err := nc.Accept()
+			if err != nil {
+				continue
+			}
+			go serveTestSession(ch, chReqs)
+		case "direct-tcpip":
+			go serveTestTCPIP(nc)
+		default:
+			nc.Reject(ssh.UnknownChannelType, "unsupported")
+		}
+	}
+}
+
+func serveTestTCPIP(nc ssh.NewChannel) {
+	var payload struct {
+		Host     string
+		Port     uint32
+		OrigHost string
+		OrigPort uint32
+	}
+	ssh.Unmarshal(nc.ExtraData(), &payload)
+
+	conn, err := net.Dial("tcp", net.JoinHostPort(payload.Host, strconv.Itoa(int(payload.Port))))
+	if err != nil {
+		nc.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+	defer conn.Close()
+
+	ch, reqs, err := nc.Accept()
+	if err != nil {
+		return
+	}
+	defer ch.Close()
+	go ssh.DiscardRequests(reqs)
+
+	go io.Copy(conn, ch)
+	io.Copy(ch, conn)
+}
+
+func serveTestSession(ch ssh.Channel, reqs <-chan *ssh.Request) {
+	defer ch.Close()
+
+	for req := range reqs {
+		if req.Type != "exec" {
+			req.Reply(req.Type == "env" || req.Type == "pty-req", nil)
+			continue
+		}
+
+		var payload struct{ Command string }
+		ssh.Unmarshal(req.Payload, &payload)
+		req.Reply(true, nil)
+
+		cmd := exec.Command("sh", "-c", payload.Command)
+		cmd.Stdout = ch
+		cmd.Stderr = ch.Stderr()
+
+		// like sshd, don't wait for the client to close stdin once the command exited
+		stdin, _ := cmd.StdinPipe()
+		go func() {
+			io.Copy(stdin, ch)
+			stdin.Close()
+		}()
+
+		status := uint32(0)
+		err := cmd.Run()
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			status = uint32(exitErr.ExitCode())
+		} else if err != nil {
+			status = 127
+		}
+
+		b := make([]byte, 4)
+		binary.BigEndian.PutUint32(b, status)
+		ch.SendRequest("exit-status", false, b)
+		return
+	}
+}
+
+func TestKeepalive(t *testing.T) {
+	// a server that stops answering, like one behind a dead link
+	node := newTestServerFunc(t, func(conn net.Conn, config *ssh.ServerConfig) {
+		sconn, chans, reqs, err := ssh.NewServerConn(conn, config)
+		if err != nil {
+			conn.Close()
+			return
+		}
+		defer sconn.Close()
+
+		go func() {
+			for range reqs {
+			}
+		}()
+		for nc := range chans {
+			nc.Reject(ssh.Prohibited, "unsupported")
+		}
+	})
+
+	c := genSSHConfig(node)
+	assert.Nil(t, c.connect(context.Background()))
+	defer c.Close()
+
+	interval := time.Millisecond * 50
+	start := time.Now()
+	err := c.keepalive(c.client, make(chan struct{}), interval, 3)
+	assert.ErrorIs(t, err, ErrHostUnreachable)
+	assert.ErrorContains(t, err, "no reply to 3 keepalives")
+	assert.GreaterOrEqual(t, time.Since(start), 4*interval)
+
+	closed := make(chan error, 1)
+	go func() {
+		closed <- c.client.Wait()
+	}()
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("connection not closed")
+	}
+}
+
+func TestConnectError(t *testing.T) {
+	node := newTestServer(t)
+
+	c := genSSHConfig(node)
+	assert.Nil(t, c.connect(context.Background()))
+	c.Close()
+
+	wrong := *node
+	wrong.Password = "wrong"
+	c = genSSHConfig(&wrong)
+	err := c.connect(context.Background())
+	assert.True(t, errors.Is(err, ErrAuthFailed), "%v", err)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	ln.Close()
+	closed := *node
+	closed.Port = ln.Addr().(*net.TCPAddr).Port
+	err = genSSHConfig(&closed).connect(context.Background())
+	assert.True(t, errors.Is(err, ErrHostUnreachable), "%v", err)
+
+	// known hosts with another key for the server
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	assert.Nil(t, err)
+	other, err := ssh.NewPublicKey(pub)
+	assert.Nil(t, err)
+	addr := net.JoinHostPort(node.Host, strconv.Itoa(node.Port))
+	known := filepath.Join(t.TempDir(), "known_hosts")
+	assert.Nil(t, os.WriteFile(known, []byte(knownhosts.Line([]string{knownhosts.Normalize(addr)}, other)+"\n"), 0600))
+
+	mismatch := *node
+	mismatch.KnownHosts = known
+	err = genSSHConfig(&mismatch).connect(context.Background())
+	assert.True(t, errors.Is(err, ErrHostKeyMismatch), "%v", err)
+	assert.False(t, errors.Is(err, ErrAuthFailed), "%v", err)
+
+	// a host missing from known hosts is no mismatch
+	assert.Nil(t, os.WriteFile(known, nil, 0600))
+	err = genSSHConfig(&mismatch).connect(context.Background())
+	assert.NotNil(t, err)
+	assert.False(t, errors.Is(err, ErrHostKeyMismatch), "%v", err)
+	assert.False(t, errors.Is(err, ErrAuthFailed), "%v", err)
+}
+
+func TestExitError(t *testing.T) {
+	node := newTestServer(t)
+
+	c := genSSHConfig(node)
+	assert.Nil(t, c.connect(context.Background()))
+	defer c.Close()
+
+	var wg sync.WaitGroup
+	for _, status := range []int{0, 3} {
+		wg.Add(1)
+		go func(status int) {
+			defer wg.Done()
+			s, err := c.client.NewSession()
+			assert.Nil(t, err)
+			err = exitError(node.Host, s.Run("exit "+strconv.Itoa(status)))
+			if status == 0 {
+				assert.Nil(t, err)
+				return
+			}
+			var exitErr *ExitError
+			assert.True(t, errors.As(err, &exitErr))
+			assert.Equal(t, status, exitErr.Status)
+		}(status)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,525 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/iamlongalong/sshw"
+)
+
+var (
+	// connection flags, they override the config of the node
+	conn struct {
+		port     int
+		identity string
+		jump     string
+		user     string
+		compress bool
+	}
+
+	forwards []sshw.Forward
+
+	// exec runs on every host selected with -tag
+	execAll bool
+
+	scpOpts struct {
+		verify   bool
+		preserve bool
+		limit    string
+		parallel int
+	}
+
+	historyOpts struct {
+		n       int
+		host    string
+		command string
+		since   time.Duration
+		failed  bool
+	}
+
+	replayOpts struct {
+		speed float64
+		idle  time.Duration
+	}
+)
+
+func connectFlags(fs *flag.FlagSet) {
+	fs.IntVar(&conn.port, "P", 0, "port to connect to")
+	fs.StringVar(&conn.identity, "i", "", "private key file")
+	fs.StringVar(&conn.jump, "J", "", "jump host, a node or [user@]host[:port]")
+	fs.StringVar(&conn.user, "user", "", "user to login as")
+}
+
+// compressFlag is for the commands that transfer data.
+func compressFlag(fs *flag.FlagSet) {
+	fs.BoolVar(&conn.compress, "C", false, "compress the transfer with gzip or zstd, when the host has them")
+}
+
+func execFlags(fs *flag.FlagSet) {
+	connectFlags(fs)
+	compressFlag(fs)
+	fs.BoolVar(&execAll, "all", false, "run the command on every host selected with -tag, one after the other")
+}
+
+func scpFlags(fs *flag.FlagSet) {
+	connectFlags(fs)
+	compressFlag(fs)
+	fs.BoolVar(&scpOpts.verify, "verify", false, "compare the sha256 of both sides after the copy")
+	fs.BoolVar(&scpOpts.preserve, "p", false, "preserve the mode and times of the file")
+	fs.StringVar(&scpOpts.limit, "limit", "", "limit the bandwidth, e.g. 5MB/s, 0 for no limit")
+	fs.IntVar(&scpOpts.parallel, "parallel", 4, "how many files are copied at once")
+}
+
+func forwardFlags(fs *flag.FlagSet) {
+	connectFlags(fs)
+	fs.Var(forwardValue(false), "L", "forward a local port to the remote side, [bind_address:]port:host:hostport")
+	fs.Var(forwardValue(true), "R", "forward a remote port to the local side, [bind_address:]port:host:hostport")
+}
+
+// forwardValue adds the forwards of -L or -R, which may be repeated.
+type forwardValue bool
+
+func (v forwardValue) String() string {
+	return ""
+}
+
+func (v forwardValue) Set(s string) error {
+	f, err := sshw.ParseForward(s, bool(v))
+	if err != nil {
+		return err
+	}
+	forwards = append(forwards, f)
+	return nil
+}
+
+func historyFlags(fs *flag.FlagSet) {
+	fs.IntVar(&historyOpts.n, "n", 20, "show the last n entries, 0 for all")
+	fs.StringVar(&historyOpts.host, "host", "", "only entries whose node path contains this")
+	fs.StringVar(&historyOpts.command, "cmd", "", "only entries of a command, e.g. login or scp")
+	fs.DurationVar(&historyOpts.since, "since", 0, "only entries newer than this, e.g. 24h")
+	fs.BoolVar(&historyOpts.failed, "failed", false, "only entries with a non zero exit status")
+}
+
+func replayFlags(fs *flag.FlagSet) {
+	fs.Float64Var(&replayOpts.speed, "speed", 1, "playback speed")
+	fs.DurationVar(&replayOpts.idle, "idle", 2*time.Second, "max idle time between frames, 0 to keep original")
+}
+
+// connectNode returns a copy of node with the connection flags applied.
+func connectNode(node *sshw.Node) *sshw.Node {
+	n := *node
+	if conn.port > 0 {
+		n.Port = conn.port
+	}
+	if conn.identity != "" {
+		n.KeyPath = conn.identity
+	}
+	if conn.user != "" {
+		n.User = conn.user
+	}
+	if conn.jump != "" {
+		n.Jump = []*sshw.Node{lookup(conn.jump)}
+	}
+	if conn.compress && (n.Compression == "" || n.Compression == "no") {
+		n.Compression = "auto"
+	}
+	return &n
+}
+
+func login(args []string) {
+	loadConfig()
+
+	var node *sshw.Node
+	switch len(args) {
+	case 0:
+		node = pick()
+		if node == nil {
+			return
+		}
+		recordHistory(node.Host)
+	case 1:
+		node = lookup(args[0])
+	default:
+		usageError("login")
+	}
+
+	loginNode(node)
+}
+
+func loginNode(node *sshw.Node) {
+	n := connectNode(node)
+	use(node, sshw.CommandLogin, func() error {
+		return sshw.NewClient(n).Login(context.Background())
+	})
+}
+
+func last(args []string) {
+	if len(args) != 0 {
+		usageError("last")
+	}
+	loadConfig()
+
+	usage, err := sshw.LoadUsage()
+	if err != nil {
+		log.Error(err)
+		os.Exit(1)
+	}
+	paths := usage.Recent(1)
+	if len(paths) == 0 {
+		log.Error("no host used yet")
+		os.Exit(1)
+	}
+	node := lookupPath(paths[0])
+	if node == nil {
+		// a host that is not in the config
+		node = lookup(paths[0])
+	}
+
+	loginNode(node)
+}
+
+func scp(args []string) {
+	loadConfig()
+
+	base := strings.Join(append([]string{"scp"}, args...), " ")
+	cmd := ""
+	cmdReady := false
+	shouldRecordHistory := false
+
+	if len(args) == 1 { // sshw scp xxxx
+		h, _, _ := sshw.ParseHostFile(args[0])
+		if h != "" {
+			cmd = base + " ./" // sshw scp xx:/tmp/x.txt  =>  sshw scp xx:/tmp/x.txt ./
+			cmdReady = true
+		}
+	}
+
+	if len(args) >= 2 {
+		cmd = base
+		cmdReady = true
+	}
+
+	if !cmdReady {
+		shouldRecordHistory = true
+		node := pick()
+		if node == nil {
+			return
+		}
+
+		msg := base + " " + node.Host + ":"
+
+		if node.User != "" {
+			msg = base + " " + node.User + "@" + node.Host + ":"
+		}
+
+		fmt.Print(msg)
+
+		reader := bufio.NewReader(os.Stdin)
+		strBytes, _, _ := reader.ReadLine()
+		after := string(strBytes)
+
+		cmd = base + " " + node.Host + ":" + after
+	}
+
+	var opts []sshw.ScpOption
+	var err error
+	if len(args) > 2 {
+		// several files into a directory
+		opts, err = sshw.ParseScpOptions(args)
+	} else {
+		var opt sshw.ScpOption
+		opt, err = sshw.ParseScpOption(cmd)
+		opts = []sshw.ScpOption{opt}
+	}
+	if err != nil {
+		log.Error(err)
+		os.Exit(1)
+	}
+
+	var limit int64
+	if scpOpts.limit != "" {
+		limit, err = sshw.ParseRate(scpOpts.limit)
+		if err != nil {
+			log.Error(err)
+			os.Exit(1)
+		}
+		if limit == 0 {
+			// no limit, not the one of the node
+			limit = -1
+		}
+	}
+	for i := range opts {
+		opts[i].Verify = scpOpts.verify
+		opts[i].Preserve = scpOpts.preserve
+		opts[i].Limit = limit
+	}
+
+	var node *sshw.Node
+	if opts[0].SrcHost != "" {
+		node = lookup(opts[0].SrcHost)
+	} else {
+		node = lookup(opts[0].TarHost)
+	}
+
+	// the first Ctrl-C aborts the copy and cleans up, a second one exits immediately
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+
+	n := connectNode(node)
+	use(node, sshw.CommandScp, func() error {
+		err := sshw.NewClient(n).ScpAll(ctx, opts, scpOpts.parallel)
+		if err != nil {
+			return err
+		}
+
+		fmt.Println("")
+		if len(opts) > 1 {
+			fmt.Printf("✅  copy %d files success\n", len(opts))
+		} else {
+			fmt.Println("✅  copy file success")
+		}
+		if scpOpts.verify {
+			fmt.Println("✅  sha256 verified")
+		}
+		fmt.Println("")
+
+		if shouldRecordHistory {
+			recordHistory(cmd)
+		}
+		return nil
+	})
+}
+
+func execute(args []string) {
+	if execAll {
+		executeAll(args)
+		return
+	}
+	if len(args) < 2 {
+		usageError("exec")
+	}
+	loadConfig()
+	node := lookup(args[0])
+
+	// the first Ctrl-C interrupts the command, a second one exits immediately
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+
+	n := connectNode(node)
+	use(node, sshw.CommandExec, func() error {
+		return sshw.NewClient(n).Exec(ctx, strings.Join(args[1:], " "))
+	})
+}
+
+// executeAll runs the command on the hosts selected with -tag, it fails when
+// it failed on any of them.
+func executeAll(args []string) {
+	if len(args) < 1 || *T == "" {
+		usageError("exec")
+	}
+	loadConfig()
+	command := strings.Join(args, " ")
+
+	// the first Ctrl-C interrupts the command and skips the rest of the hosts
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+
+	failed := 0
+	for _, node := range roots {
+		if ctx.Err() != nil {
+			break
+		}
+
+		fmt.Printf("==> %s <==\n", config.Path(node))
+		start := time.Now()
+		err := sshw.NewClient(connectNode(node)).Exec(ctx, command)
+		record(node, sshw.CommandExec, start, err)
+		if err != nil {
+			failed++
+			log.Errorf("%s : %s", node.Name, err)
+		}
+	}
+
+	exit(ctx.Err())
+	if failed > 0 {
+		log.Errorf("failed on %d of %d hosts", failed, len(roots))
+		os.Exit(1)
+	}
+}
+
+func forward(args []string) {
+	if len(args) != 1 || len(forwards) == 0 {
+		usageError("forward")
+	}
+	loadConfig()
+	node := lookup(args[0])
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	for _, f := range forwards {
+		fmt.Println("forwarding", f)
+	}
+
+	n := connectNode(node)
+	use(node, sshw.CommandForward, func() error {
+		return sshw.NewClient(n).Forward(ctx, forwards...)
+	})
+}
+
+func configure(args []string) {
+	action := "list"
+	if len(args) > 0 {
+		action = args[0]
+	}
+	if len(args) > 1 {
+		usageError("config")
+	}
+
+	switch action {
+	case "list":
+		loadConfig()
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		for _, h := range hosts() {
+			addr := h.Host
+			if h.User != "" {
+				addr = h.User + "@" + addr
+			}
+			if h.Port > 0 {
+				addr += ":" + strconv.Itoa(h.Port)
+			}
+			var tags string
+			for _, tag := range h.AllTags() {
+				tags += " #" + tag
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\n", h.Path, addr, strings.TrimSpace(tags))
+		}
+		w.Flush()
+	case "path":
+		fmt.Println(configPath())
+	case "edit":
+		p := configPath()
+		editor := os.Getenv("VISUAL")
+		if editor == "" {
+			editor = os.Getenv("EDITOR")
+		}
+		if editor == "" {
+			editor = "vi"
+		}
+
+		cmd := exec.Command(editor, p)
+		cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+		err := cmd.Run()
+		if err != nil {
+			log.Error(err)
+			os.Exit(1)
+		}
+		// report mistakes right away, not on the next login
+		loadConfig()
+	default:
+		usageError("config")
+	}
+}
+
+func configPath() string {
+	if *S {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			log.Error(err)
+			os.Exit(1)
+		}
+		return filepath.Join(home, ".ssh", "config")
+	}
+
+	p, err := sshw.ConfigPath()
+	if err != nil {
+		log.Error("find config error", err)
+		os.Exit(1)
+	}
+	return p
+}
+
+func history(args []string) {
+	if len(args) != 0 {
+		usageError("history")
+	}
+
+	usage, err := sshw.LoadUsage()
+	if err != nil {
+		log.Error(err)
+		os.Exit(1)
+	}
+
+	filter := sshw.UsageFilter{Path: historyOpts.host, Command: historyOpts.command, Failed: historyOpts.failed}
+	if historyOpts.since > 0 {
+		filter.Since = time.Now().Add(-historyOpts.since)
+	}
+	entries := usage.Filter(filter)
+	if n := historyOpts.n; n > 0 && len(entries) > n {
+		entries = entries[len(entries)-n:]
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	for _, e := range entries {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\n", e.Time.Format("2006-01-02 15:04:05"), e.Command, e.Path, e.Duration.Round(time.Second), e.Status)
+	}
+	w.Flush()
+}
+
+func replay(args []string) {
+	if len(args) != 1 {
+		usageError("replay")
+	}
+
+	f, err := os.Open(args[0])
+	if err != nil {
+		log.Error(err)
+		os.Exit(1)
+	}
+	defer f.Close()
+
+	err = sshw.Replay(f, os.Stdout, replayOpts.speed, replayOpts.idle)
+	if err != nil {
+		log.Error(err)
+		os.Exit(1)
+	}
+}
+
+// daemon serves shared connections for nodes with multiplex, it is started on
+// demand and exits when idle.
+func daemon(args []string) {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	d, err := sshw.NewDaemon()
+	if err != nil {
+		log.Error(err)
+		os.Exit(1)
+	}
+
+	err = d.ListenAndServe(ctx)
+	if err != nil {
+		log.Error(err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/iamlongalong/sshw"
+)
+
+const remoteCompleteTimeout = time.Second * 5
+
+// the scripts pass the command line up to the cursor to `sshw __complete`,
+// which prints one candidate per line, escaped for the shell
+var completionScripts = map[string]string{
+	"bash": `_sshw() {
+    local IFS=$'\n'
+    COMPREPLY=($(sshw __complete bash "${COMP_LINE:0:COMP_POINT}" </dev/null 2>/dev/null))
+    if [[ ${#COMPREPLY[@]} -eq 1 && ${COMPREPLY[0]} == *[/:] ]]; then
+        compopt -o nospace
+    fi
+}
+complete -F _sshw sshw
+`,
+	"zsh": `#compdef sshw
+
+_sshw() {
+    local -a candidates spaced unspaced
+    candidates=("${(@f)$(sshw __complete zsh "$LBUFFER" </dev/null 2>/dev/null)}")
+    spaced=(${candidates:#*[/:]})
+    unspaced=(${(M)candidates:#*[/:]})
+    compadd -a spaced
+    compadd -S '' -a unspaced
+}
+
+compdef _sshw sshw
+`,
+	"fish": `complete -c sshw -f -a '(sshw __complete fish (commandline -cp) </dev/null 2>/dev/null)'
+`,
+}
+
+var completeArgs = map[string][]string{
+	"completion": {"bash", "zsh", "fish"},
+	"config":     {"list", "path", "edit"},
+}
+
+func completion(args []string) {
+	if len(args) != 1 || completionScripts[args[0]] == "" {
+		fmt.Fprintln(os.Stderr, "usage: sshw completion bash|zsh|fish")
+		os.Exit(1)
+	}
+	fmt.Print(completionScripts[args[0]])
+}
+
+// complete prints the candidates for the last word of a command line, args
+// are the shell and the line.
+func complete(args []string) {
+	if len(args) != 2 {
+		os.Exit(1)
+	}
+	shell := args[0]
+
+	// connecting may print prompts and log errors, keep them out of the candidates
+	out := os.Stdout
+	os.Stdout, _ = os.Open(os.DevNull)
+	sshw.SetLogger(discardLogger{})
+
+	words := splitWords(args[1])
+	if len(words) < 2 {
+		return
+	}
+	cur := words[len(words)-1]
+
+	var matches []string
+	for _, c := range candidates(words[1:len(words)-1], cur) {
+		if strings.HasPrefix(c, cur) {
+			matches = append(matches, c)
+		}
+	}
+
+	for _, c := range matches {
+		if shell == "bash" {
+			// bash breaks words at colons, so it only replaces what follows the last one
+			if i := strings.LastIndex(cur, ":"); i >= 0 {
+				c = c[i+1:]
+			}
+			c = bashEscape(c)
+		}
+		fmt.Fprintln(out, c)
+	}
+}
+
+// candidates returns what may follow words, cur is the word being completed.
+func candidates(words []string, cur string) []string {
+	// the global flags before the command
+	args, useSshConfig := skipFlags(flag.CommandLine, words)
+	if len(args) == 0 {
+		if strings.HasPrefix(cur, "-") {
+			return flagNames(flag.CommandLine)
+		}
+		var names []string
+		for _, c := range commands {
+			if !c.hidden {
+				names = append(names, c.name)
+			}
+		}
+		return append(names, hostNames(useSshConfig, "")...)
+	}
+
+	c := lookupCommand(args[0])
+	if c == nil || c.hidden {
+		// login by name
+		return nil
+	}
+	fs := c.flagSet()
+	if strings.HasPrefix(cur, "-") {
+		return flagNames(fs)
+	}
+	args, s := skipFlags(fs, args[1:])
+	useSshConfig = useSshConfig || s
+
+	switch c.name {
+	case "login", "exec", "forward":
+		if len(args) == 0 {
+			return hostNames(useSshConfig, "")
+		}
+	case "scp":
+		host, p, found := strings.Cut(cur, ":")
+		if !found {
+			return append(hostNames(useSshConfig, ":"), localPaths(cur)...)
+		}
+		return remotePaths(useSshConfig, host, p)
+	case "replay":
+		return localPaths(cur)
+	default:
+		if len(args) == 0 {
+			return completeArgs[c.name]
+		}
+	}
+	return nil
+}
+
+// skipFlags returns the words after the flags of fs, and whether -s is among them.
+func skipFlags(fs *flag.FlagSet, words []string) ([]string, bool) {
+	useSshConfig := false
+	for len(words) > 0 && strings.HasPrefix(words[0], "-") && words[0] != "-" {
+		name, _, hasValue := strings.Cut(strings.TrimLeft(words[0], "-"), "=")
+		words = words[1:]
+		if name == "s" {
+			useSshConfig = true
+		}
+		f := fs.Lookup(name)
+		if f == nil || hasValue {
+			continue
+		}
+		if b, ok := f.Value.(interface{ IsBoolFlag() bool }); ok && b.IsBoolFlag() {
+			continue
+		}
+		if len(words) > 0 {
+			words = words[1:]
+		}
+	}
+	return words, useSshConfig
+}
+
+func flagNames(fs *flag.FlagSet) []string {
+	var names []string
+	fs.VisitAll(func(f *flag.Flag) {
+		names = append(names, "-"+f.Name)
+	})
+	return names
+}
+
+func loadCompletionConfig(useSshConfig bool) *sshw.Config {
+	var c *sshw.Config
+	var err error
+	if useSshConfig {
+		c, err = sshw.LoadSshConfig()
+	} else {
+		c, err = sshw.LoadConfig()
+	}
+	if err != nil {
+		return nil
+	}
+	return c
+}
+
+// hostNames returns the names and aliases of the hosts, names with spaces are
+// left out when suffix is set, as scp arguments can not contain them.
+func hostNames(useSshConfig bool, suffix string) []string {
+	c := loadCompletionConfig(useSshConfig)
+	if c == nil {
+		return nil
+	}
+
+	var names []string
+	seen := make(map[string]bool)
+	for _, h := range c.Hosts() {
+		for _, name := range []string{h.Name, h.Alias} {
+			if name == "" || seen[name] || suffix != "" && strings.ContainsAny(name, " \t") {
+				continue
+			}
+			seen[name] = true
+			names = append(names, name+suffix)
+		}
+	}
+	return names
+}
+
+func remotePaths(useSshConfig bool, host, prefix string) []string {
+	c := loadCompletionConfig(useSshConfig)
+	if c == nil {
+		return nil
+	}
+	node := c.Target(host)
+
+	ctx, cancel := context.WithTimeout(context.Background(), remoteCompleteTimeout)
+	defer cancel()
+
+	// with multiplex, the next completion finds the connection of the daemon
+	// open, without the listing is cached for the next keys
+	entries, err := sshw.CompleteNodePath(ctx, node, prefix)
+	if err != nil {
+		return nil
+	}
+	for i := range entries {
+		entries[i] = host + ":" + entries[i]
+	}
+	return entries
+}
+
+func localPaths(prefix string) []string {
+	matches, _ := filepath.Glob(globEscape(prefix) + "*")
+	for i, m := range matches {
+		if fi, err := os.Stat(m); err == nil && fi.IsDir() {
+			matches[i] = m + string(filepath.Separator)
+		}
+	}
+	return matches
+}
+
+func globEscape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "*", `\*`, "?", `\?`, "[", `\[`).Replace(s)
+}
+
+// splitWords splits a command line like a posix shell, the last word is the
+// one under the cursor and empty after a space.
+func splitWords(line string) []string {
+	var words []string
+	var word strings.Builder
+	var quote rune
+	escaped := false
+	for _, r := range line {
+		switch {
+		case escaped:
+			word.WriteRune(r)
+			escaped = false
+		case r == '\\' && quote != '\'':
+			escaped = true
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else {
+				word.WriteRune(r)
+			}
+		case r == '\'' || r == '"':
+			quote = r
+		case r == ' ' || r == '\t':
+			if word.Len() > 0 {
+				words = append(words, word.String())
+				word.Reset()
+			}
+		default:
+			word.WriteRune(r)
+		}
+	}
+	return append(words, word.String())
+}
+
+func bashEscape(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		if strings.ContainsRune(" \t'\"\\$`!&;|<>()[]{}*?#~", r) {
+			b.WriteRune('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+type discardLogger struct{}
+
+func (discardLogger) Info(args ...interface{})                  {}
+func (discardLogger) Infof(format string, args ...interface{})  {}
+func (discardLogger) Error(args ...interface{})                 {}
+func (discardLogger) Errorf(format string, args ...interface{}) {}
@@ -1,100 +1,111 @@
 package main
 
 import (
-	"bufio"
+	"errors"
 	"flag"
 	"fmt"
 	"os"
 	"runtime"
-	"strings"
+	"time"
 
 	"github.com/iamlongalong/sshw"
 
 	"github.com/manifoldco/promptui"
+	"golang.org/x/crypto/ssh/terminal"
 )
 
-const prev = "-parent-"
-
 var (
 	Build = "devel"
 	V     = flag.Bool("version", false, "show version")
 	H     = flag.Bool("help", false, "show help")
-	S     = flag.Bool("s", false, "use local ssh config '~/.ssh/config'")
+	S     = new(bool)
+	T     = new(string)
+	F     = new(bool)
 
 	log = sshw.GetLogger()
 
-	templates = &promptui.SelectTemplates{
-		Label:    "✨ {{ . | green}}",
-		Active:   "➤ {{ .Name | cyan  }}{{if .Alias}}({{.Alias | yellow}}){{end}} {{if .Host}}{{if .User}}{{.User | faint}}{{`@` | faint}}{{end}}{{.Host | faint}}{{end}}",
-		Inactive: "  {{.Name | faint}}{{if .Alias}}({{.Alias | faint}}){{end}} {{if .Host}}{{if .User}}{{.User | faint}}{{`@` | faint}}{{end}}{{.Host | faint}}{{end}}",
-	}
+	config *sshw.Config
+	// roots is the top level of the picker
+	roots []*sshw.Node
 )
 
-func findName(nodes []*sshw.Node, name string) *sshw.Node {
-	for _, node := range nodes {
-		if node.Name == name {
-			return node
-		}
-		if len(node.Children) > 0 {
-			n := findName(node.Children, name)
-			if n != nil {
-				return n
-			}
-		}
-	}
-	return nil
+// command is a subcommand of sshw, its flags are parsed together with the global ones.
+type command struct {
+	name   string
+	args   string
+	help   string
+	hidden bool
+	flags  func(fs *flag.FlagSet)
+	run    func(args []string)
 }
 
-func findNameOrAliasOrHost(nodes []*sshw.Node, nameOrAliasOrHost string) *sshw.Node {
-	node := findName(nodes, nameOrAliasOrHost)
-	if node != nil {
-		return node
+var commands []*command
+
+func init() {
+	globalFlags(flag.CommandLine)
+
+	commands = []*command{
+		{name: "login", args: "[host]", help: "login to a host, pick one when it is not given", flags: connectFlags, run: login},
+		{name: "scp", args: "[src...] [target]", help: "copy files from or to a host, e.g. sshw scp a.txt b.txt host:~/", flags: scpFlags, run: scp},
+		{name: "exec", args: "<host> <command...> | -all <command...>", help: "run a command on a host, or on all hosts of -tag", flags: execFlags, run: execute},
+		{name: "forward", args: "<host>", help: "forward ports through a host until interrupted", flags: forwardFlags, run: forward},
+		{name: "config", args: "[list|path|edit]", help: "list the hosts, print the path of the config or edit it", run: configure},
+		{name: "last", help: "login to the last used host again", flags: connectFlags, run: last},
+		{name: "history", help: "show the hosts used before", flags: historyFlags, run: history},
+		{name: "replay", args: "<file.cast>", help: "replay a recorded session", flags: replayFlags, run: replay},
+		{name: "completion", args: "bash|zsh|fish", help: "print a shell completion script", run: completion},
+		{name: "daemon", hidden: true, run: daemon},
+		{name: "__complete", hidden: true, run: complete},
 	}
+}
 
-	node = findAlias(nodes, nameOrAliasOrHost)
-	if node != nil {
-		return node
-	}
+// globalFlags are accepted before and after the subcommand.
+func globalFlags(fs *flag.FlagSet) {
+	fs.BoolVar(S, "s", *S, "use local ssh config '~/.ssh/config'")
+	fs.StringVar(T, "tag", *T, "only show hosts matching tags, e.g. prod,db|cache,!eu-west")
+	fs.BoolVar(F, "f", *F, "start with the fuzzy finder across all hosts")
+}
 
-	return findHost(nodes, nameOrAliasOrHost)
+func (c *command) flagSet() *flag.FlagSet {
+	fs := flag.NewFlagSet(c.name, flag.ExitOnError)
+	globalFlags(fs)
+	if c.flags != nil {
+		c.flags(fs)
+	}
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: sshw %s [flags] %s\n\n%s\n\nflags:\n", c.name, c.args, c.help)
+		fs.PrintDefaults()
+	}
+	return fs
 }
 
-func findHost(nodes []*sshw.Node, nodeHost string) *sshw.Node {
-	for _, node := range nodes {
-		if node.Host == nodeHost {
-			return node
-		}
-		if len(node.Children) > 0 {
-			node = findHost(node.Children, nodeHost)
-			if node != nil {
-				return node
-			}
+func lookupCommand(name string) *command {
+	for _, c := range commands {
+		if c.name == name {
+			return c
 		}
 	}
 	return nil
 }
 
-func findAlias(nodes []*sshw.Node, nodeAlias string) *sshw.Node {
-	for _, node := range nodes {
-		if node.Alias == nodeAlias {
-			return node
-		}
-		if len(node.Children) > 0 {
-			node = findAlias(node.Children, nodeAlias)
-			if node != nil {
-				return node
-			}
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintln(out, "usage: sshw [flags] [command] [args]")
+	fmt.Fprintln(out, "\ncommands:")
+	for _, c := range commands {
+		if !c.hidden {
+			fmt.Fprintf(out, "  %-11s%s\n", c.name, c.help)
 		}
 	}
-	return nil
+	fmt.Fprintf(out, "  %-11s%s\n", "<host>", "same as login <host>")
+	fmt.Fprintln(out, "\nflags:")
+	flag.PrintDefaults()
+	fmt.Fprintln(out, "\nrun 'sshw <command> -help' for the flags of a command.")
 }
 
 func main() {
+	flag.Usage = usage
 	flag.Parse()
-	if !flag.Parsed() {
-		flag.Usage()
-		return
-	}
 
 	if *H {
 		flag.Usage()
@@ -107,168 +118,174 @@ func main() {
 		fmt.Println("  go version :", runtime.Version())
 		return
 	}
+
+	// nodes with multiplex start the daemon on demand
+	if exe, err := os.Executable(); err == nil {
+		sshw.DaemonCommand = []string{exe, "daemon"}
+	}
+
+	// without a command, the arguments are the ones of login
+	args := flag.Args()
+	c := lookupCommand("login")
+	if len(args) > 0 {
+		if cmd := lookupCommand(args[0]); cmd != nil {
+			c, args = cmd, args[1:]
+		}
+	}
+
+	fs := c.flagSet()
+	fs.Parse(args)
+	c.run(fs.Args())
+}
+
+// usageError prints the usage of a command and exits.
+func usageError(name string) {
+	lookupCommand(name).flagSet().Usage()
+	os.Exit(2)
+}
+
+func loadConfig() {
+	var err error
 	if *S {
-		err := sshw.LoadSshConfig()
+		config, err = sshw.LoadSshConfig()
 		if err != nil {
 			log.Error("load ssh config error", err)
 			os.Exit(1)
 		}
 	} else {
-		err := sshw.LoadConfig()
+		config, err = sshw.LoadConfig()
 		if err != nil {
 			log.Error("load config error", err)
 			os.Exit(1)
 		}
 	}
 
-	var nodes = sshw.GetConfig()
-
-	if len(os.Args) > 1 {
-		switch os.Args[1] {
-		case "scp":
-			base := strings.Join(os.Args[1:len(os.Args)], " ")
-			cmd := ""
-			cmdReady := false
-			shouldRecordHistory := false
-
-			if len(os.Args) == 3 { // sshw scp xxxx
-				src := os.Args[2]
-				h, _, _ := sshw.ParseHostFile(src)
-				if h != "" {
-					cmd = base + " ./" // sshw scp xx:/tmp/x.txt  =>  sshw scp xx:/tmp/x.txt ./
-					cmdReady = true
-				}
-			}
-
-			if len(os.Args) >= 4 {
-				cmd = base
-				cmdReady = true
-			}
-
-			if !cmdReady {
-				shouldRecordHistory = true
-				node := choose(nil, sshw.GetConfig())
-				if node == nil {
-					return
-				}
-
-				msg := base + " " + node.Host + ":"
-
-				if node.User != "" {
-					msg = base + " " + node.User + "@" + node.Host + ":"
-				}
-
-				fmt.Print(msg)
-
-				reader := bufio.NewReader(os.Stdin)
-				strBytes, _, _ := reader.ReadLine()
-				after := string(strBytes)
-
-				cmd = base + " " + node.Host + ":" + after
-			}
-
-			// opt, err := sshw.ParseScpOption(base)
-			opt, err := sshw.ParseScpOption(cmd)
-			if err != nil {
-				log.Error(err)
-				os.Exit(1)
-				return
-			}
-
-			var node *sshw.Node
-
-			if opt.SrcHost != "" {
-				node = findNameOrAliasOrHost(nodes, opt.SrcHost)
-				if node == nil {
-					log.Errorf("can not find node of : %s", opt.SrcHost)
-					os.Exit(1)
-					return
-				}
-			} else {
-				node = findNameOrAliasOrHost(nodes, opt.TarHost)
-				if node == nil {
-					log.Errorf("can not find node of : %s", opt.TarHost)
-					os.Exit(1)
-					return
-				}
-			}
-
-			client := sshw.NewClient(node)
-			client.Scp(opt)
-
-			if shouldRecordHistory {
-				sshw.RecordHistory(cmd)
-			}
-			return
-		default: // login by alias
-			var nodeAlias = os.Args[1]
-			var node = findNameOrAliasOrHost(nodes, nodeAlias)
-			if node != nil {
-				client := sshw.NewClient(node)
-				client.Login()
-				return
-			}
+	roots = config.Nodes
+	if *T != "" {
+		roots = config.Select(*T)
+		if len(roots) == 0 {
+			log.Errorf("no host matches tags : %s", *T)
+			os.Exit(1)
 		}
 	}
+}
 
-	node := choose(nil, sshw.GetConfig())
-	if node == nil {
+// lookup finds a node of the config by name, alias or host, anything else is
+// taken as an ad-hoc [user@]host[:port].
+func lookup(name string) *sshw.Node {
+	return config.Target(name)
+}
+
+// pick lets the user choose a host, nil when canceled.
+func pick() *sshw.Node {
+	if *F {
+		return find()
+	}
+	return choose(nil, roots, true)
+}
+
+// recordHistory adds the command to the shell history, so that a host picked
+// interactively can be reached again from there.
+func recordHistory(cmd string) {
+	if config.DisableHistory {
 		return
 	}
 
-	client := sshw.NewClient(node)
-	sshw.RecordHistory(node.Host)
-	client.Login()
+	err := sshw.RecordHistory(cmd)
+	if err != nil && !errors.Is(err, sshw.ErrUnknownShell) {
+		log.Error(err)
+	}
+}
+
+// use runs fn for node, records it in the usage history and exits with its status.
+func use(node *sshw.Node, command string, fn func() error) {
+	start := time.Now()
+	err := fn()
+	record(node, command, start, err)
+	exit(err)
+}
+
+// record adds the use of node to the usage history.
+func record(node *sshw.Node, command string, start time.Time, err error) {
+	path := config.Path(node)
+	if path == "" {
+		// not in the config, the target it was given as
+		path = node.Name
+
+		// the settings of a pattern would be lost, it matches the host again anyway
+		var exitErr *sshw.ExitError
+		if (err == nil || errors.As(err, &exitErr)) && config.Pattern(node.Name) == nil {
+			offerSave(node)
+		}
+	}
+
+	usage, uerr := sshw.LoadUsage()
+	if uerr == nil {
+		uerr = usage.Add(sshw.UsageEntry{
+			Time:     start,
+			Path:     path,
+			Command:  command,
+			Duration: time.Since(start),
+			Status:   exitStatus(err),
+		})
+	}
+	if uerr != nil {
+		log.Error(uerr)
+	}
 }
 
-func choose(parent, trees []*sshw.Node) *sshw.Node {
-	prompt := promptui.Select{
-		Label:        "select host",
-		Items:        trees,
-		Templates:    templates,
-		Size:         20,
-		HideSelected: true,
-		Searcher: func(input string, index int) bool {
-			node := trees[index]
-			content := fmt.Sprintf("%s %s %s", node.Name, node.User, node.Host)
-			if strings.Contains(input, " ") {
-				for _, key := range strings.Split(input, " ") {
-					key = strings.TrimSpace(key)
-					if key != "" {
-						if !strings.Contains(content, key) {
-							return false
-						}
-					}
-				}
-				return true
-			}
-			if strings.Contains(content, input) {
-				return true
-			}
-			return false
-		},
+// offerSave asks to add a host that is not in the config to it.
+func offerSave(node *sshw.Node) {
+	if *S || !terminal.IsTerminal(int(os.Stdin.Fd())) {
+		return
 	}
-	index, _, err := prompt.Run()
+	p, err := sshw.ConfigPath()
 	if err != nil {
-		return nil
+		return
 	}
 
-	node := trees[index]
-	if len(node.Children) > 0 {
-		first := node.Children[0]
-		if first.Name != prev {
-			first = &sshw.Node{Name: prev}
-			node.Children = append(node.Children[:0], append([]*sshw.Node{first}, node.Children...)...)
-		}
-		return choose(trees, node.Children)
+	confirm := promptui.Prompt{Label: fmt.Sprintf("save %s to %s", node.Name, p), IsConfirm: true}
+	if _, err := confirm.Run(); err != nil {
+		return
+	}
+	prompt := promptui.Prompt{Label: "name", Default: node.Host}
+	name, err := prompt.Run()
+	if err != nil {
+		return
 	}
 
-	if node.Name == prev {
-		if parent == nil {
-			return choose(nil, sshw.GetConfig())
-		}
-		return choose(nil, parent)
+	err = sshw.AppendNode(p, &sshw.Node{Name: name, Host: node.Host, User: node.User, Port: node.Port})
+	if err != nil {
+		log.Error("save config error", err)
+	}
+}
+
+// exitStatus is the remote exit status, or 255 for connection errors like ssh does.
+func exitStatus(err error) int {
+	if err == nil {
+		return 0
+	}
+
+	var exitErr *sshw.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.Status
+	}
+
+	var connErr *sshw.ConnectError
+	if errors.As(err, &connErr) {
+		return 255
+	}
+	return 1
+}
+
+func exit(err error) {
+	if err == nil {
+		return
 	}
 
-	return node
+	var exitErr *sshw.ExitError
+	if !errors.As(err, &exitErr) {
+		log.Error(err)
+	}
+	os.Exit(exitStatus(err))
 }
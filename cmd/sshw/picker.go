@@ -0,0 +1,232 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/iamlongalong/sshw"
+
+	"github.com/manifoldco/promptui"
+)
+
+const (
+	prev   = "-parent-"
+	search = "🔍 search all hosts"
+	recent = "🕘 recent"
+
+	recentSize = 5
+)
+
+var (
+	templates = &promptui.SelectTemplates{
+		Label:    "✨ {{ . | green}}",
+		Active:   "➤ {{ .Name | cyan  }}{{if .Alias}}({{.Alias | yellow}}){{end}} {{if .Host}}{{if .User}}{{.User | faint}}{{`@` | faint}}{{end}}{{.Host | faint}}{{end}}{{range .AllTags}} {{`#` | blue}}{{. | blue}}{{end}}",
+		Inactive: "  {{.Name | faint}}{{if .Alias}}({{.Alias | faint}}){{end}} {{if .Host}}{{if .User}}{{.User | faint}}{{`@` | faint}}{{end}}{{.Host | faint}}{{end}}{{range .AllTags}} {{`#` | faint}}{{. | faint}}{{end}}",
+	}
+
+	findTemplates = &promptui.SelectTemplates{
+		Label:    "✨ {{ . | green}}",
+		Active:   "➤ {{ .Path | cyan  }}{{if .Alias}}({{.Alias | yellow}}){{end}} {{if .User}}{{.User | faint}}{{`@` | faint}}{{end}}{{.Host | faint}}{{range .AllTags}} {{`#` | blue}}{{. | blue}}{{end}}",
+		Inactive: "  {{.Path | faint}}{{if .Alias}}({{.Alias | faint}}){{end}} {{if .User}}{{.User | faint}}{{`@` | faint}}{{end}}{{.Host | faint}}{{range .AllTags}} {{`#` | faint}}{{. | faint}}{{end}}",
+	}
+)
+
+// choose lets the user pick from trees, parent is the level to go back to and
+// top is set for the top level of the picker.
+func choose(parent, trees []*sshw.Node, top bool) *sshw.Node {
+	// the top level starts with the fuzzy finder and the recently used hosts
+	if top {
+		entries := []*sshw.Node{{Name: search}}
+		if nodes := recentNodes(); len(nodes) > 0 {
+			entries = append(entries, &sshw.Node{Name: recent, Children: nodes})
+		}
+		trees = append(entries, trees...)
+	}
+
+	prompt := promptui.Select{
+		Label:        "select host",
+		Items:        trees,
+		Templates:    templates,
+		Size:         20,
+		HideSelected: true,
+		Searcher: func(input string, index int) bool {
+			node := trees[index]
+			content := fmt.Sprintf("%s %s %s", node.Name, node.User, node.Host)
+			for _, tag := range node.AllTags() {
+				content += " #" + tag
+			}
+			if strings.Contains(input, " ") {
+				for _, key := range strings.Split(input, " ") {
+					key = strings.TrimSpace(key)
+					if key != "" {
+						if !strings.Contains(content, key) {
+							return false
+						}
+					}
+				}
+				return true
+			}
+			if strings.Contains(content, input) {
+				return true
+			}
+			return false
+		},
+	}
+	index, _, err := prompt.Run()
+	if err != nil {
+		return nil
+	}
+
+	node := trees[index]
+	if node.Name == search && node.Host == "" {
+		return find()
+	}
+
+	if len(node.Children) > 0 {
+		first := node.Children[0]
+		if first.Name != prev {
+			first = &sshw.Node{Name: prev}
+			node.Children = append(node.Children[:0], append([]*sshw.Node{first}, node.Children...)...)
+		}
+		if top {
+			// back to the top level rebuilds it, with the recent hosts up to date
+			return choose(nil, node.Children, false)
+		}
+		return choose(trees, node.Children, false)
+	}
+
+	if node.Name == prev {
+		if parent == nil {
+			return choose(nil, roots, true)
+		}
+		return choose(nil, parent, false)
+	}
+
+	if node.IsPattern() {
+		// a template for hosts, ask which one
+		label := node.Host
+		if strings.ContainsAny(node.Name, "*?") {
+			label = node.Name
+		}
+		prompt := promptui.Prompt{Label: "host (" + label + ")"}
+		host, err := prompt.Run()
+		if err != nil || host == "" {
+			return nil
+		}
+		return lookup(host)
+	}
+
+	return node
+}
+
+type findEntry struct {
+	*sshw.HostNode
+	match bool
+}
+
+// hosts returns the hosts of all groups, only the selected ones with -tag.
+func hosts() []*sshw.HostNode {
+	hosts := config.Hosts()
+	if *T == "" {
+		return hosts
+	}
+
+	selected := make(map[*sshw.Node]bool)
+	for _, n := range roots {
+		selected[n] = true
+	}
+	filtered := hosts[:0]
+	for _, h := range hosts {
+		if selected[h.Node] {
+			filtered = append(filtered, h)
+		}
+	}
+	return filtered
+}
+
+func lookupPath(path string) *sshw.Node {
+	for _, h := range hosts() {
+		if h.Path == path {
+			return h.Node
+		}
+	}
+	return nil
+}
+
+// recentNodes returns the hosts used last, most recent first.
+func recentNodes() []*sshw.Node {
+	usage, err := sshw.LoadUsage()
+	if err != nil {
+		log.Error(err)
+		return nil
+	}
+
+	var nodes []*sshw.Node
+	for _, p := range usage.Recent(len(usage.Entries)) {
+		if node := lookupPath(p); node != nil {
+			nodes = append(nodes, node)
+			if len(nodes) == recentSize {
+				break
+			}
+		}
+	}
+	return nodes
+}
+
+// find is a fuzzy finder across the hosts of all groups, ranked by how well
+// they match and how often they were used.
+func find() *sshw.Node {
+	hosts := hosts()
+	if len(hosts) == 0 {
+		return nil
+	}
+
+	usage, err := sshw.LoadUsage()
+	if err != nil {
+		log.Error(err)
+	}
+
+	all := sshw.RankHosts(hosts, "", usage)
+	entries := make([]*findEntry, len(all))
+	for i, h := range all {
+		entries[i] = &findEntry{HostNode: h, match: true}
+	}
+
+	prompt := promptui.Select{
+		Label:             "search host",
+		Items:             entries,
+		Templates:         findTemplates,
+		Size:              20,
+		HideSelected:      true,
+		StartInSearchMode: true,
+		// promptui can only filter, so the entries are reordered in place by
+		// rank when the first one is asked for, and the rest only looked up.
+		// The hosts that do not match follow, all of them are shown again
+		// when the search is canceled.
+		Searcher: func(input string, index int) bool {
+			if index == 0 {
+				ranked := sshw.RankHosts(hosts, input, usage)
+				matched := make(map[*sshw.HostNode]bool, len(ranked))
+				for _, h := range ranked {
+					matched[h] = true
+				}
+				for _, h := range all {
+					if !matched[h] {
+						ranked = append(ranked, h)
+					}
+				}
+				for i := range entries {
+					entries[i].HostNode = ranked[i]
+					entries[i].match = matched[ranked[i]]
+				}
+			}
+			return entries[index].match
+		},
+	}
+	index, _, err := prompt.Run()
+	if err != nil {
+		return nil
+	}
+
+	return entries[index].Node
+}
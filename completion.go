@@ -0,0 +1,142 @@
+package sshw
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/atrox/homedir"
+	"github.com/pkg/errors"
+)
+
+const completeCacheTTL = time.Second * 30
+
+// CompleteRemotePath returns the entries of the remote directory of prefix
+// whose names start with the rest of prefix, directories end with /. Hidden
+// entries are only listed when the name starts with a dot. The client is
+// connected when it is not yet.
+func CompleteRemotePath(ctx context.Context, c Client, prefix string) ([]string, error) {
+	dir, _ := path.Split(prefix)
+	names, err := listRemoteDir(ctx, c, dir)
+	if err != nil {
+		return nil, err
+	}
+	return matchNames(names, prefix), nil
+}
+
+// CompleteNodePath is CompleteRemotePath on node. Without multiplex, every
+// completion would connect again, so the listings are cached for a while
+// under ~/.sshw.d/complete.
+func CompleteNodePath(ctx context.Context, node *Node, prefix string) ([]string, error) {
+	dir, _ := path.Split(prefix)
+
+	var cache string
+	if !node.Multiplex {
+		p, err := homedir.Expand(dataDir)
+		if err != nil {
+			return nil, err
+		}
+		cache = filepath.Join(p, "complete", fmt.Sprintf("%x", sha256.Sum256([]byte(node.key()+"\x00"+dir))))
+		if names, ok := readCompleteCache(cache); ok {
+			return matchNames(names, prefix), nil
+		}
+	}
+
+	c := NewClient(node)
+	defer c.Close()
+	names, err := listRemoteDir(ctx, c, dir)
+	if err != nil {
+		return nil, err
+	}
+	if cache != "" {
+		writeCompleteCache(cache, names)
+	}
+	return matchNames(names, prefix), nil
+}
+
+// listRemoteDir returns the names in the remote directory dir, directories end with /.
+func listRemoteDir(ctx context.Context, c Client, dir string) ([]string, error) {
+	err := c.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	session, err := c.SSHClient().NewSession()
+	if err != nil {
+		return nil, errors.Wrap(err, "new session fail")
+	}
+	defer session.Close()
+
+	out, err := session.Output("ls -1Ap -- " + remoteDir(dir) + " 2>/dev/null")
+	if err != nil && len(out) == 0 {
+		// an empty or missing directory, nothing to complete
+		return nil, nil
+	}
+
+	var names []string
+	for _, name := range strings.Split(string(out), "\n") {
+		if name != "" {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+// matchNames returns the names of the directory of prefix that complete it.
+func matchNames(names []string, prefix string) []string {
+	dir, base := path.Split(prefix)
+
+	var entries []string
+	for _, name := range names {
+		if !strings.HasPrefix(name, base) {
+			continue
+		}
+		if strings.HasPrefix(name, ".") && !strings.HasPrefix(base, ".") {
+			continue
+		}
+		entries = append(entries, dir+name)
+	}
+	return entries
+}
+
+// readCompleteCache returns the names cached at p unless they are outdated.
+func readCompleteCache(p string) ([]string, bool) {
+	info, err := os.Stat(p)
+	if err != nil || time.Since(info.ModTime()) > completeCacheTTL {
+		return nil, false
+	}
+	b, err := os.ReadFile(p)
+	if err != nil {
+		return nil, false
+	}
+	if len(b) == 0 {
+		return nil, true
+	}
+	return strings.Split(string(b), "\n"), true
+}
+
+// writeCompleteCache caches names at p, a failure only makes the next completion slower.
+func writeCompleteCache(p string, names []string) {
+	if os.MkdirAll(filepath.Dir(p), 0700) != nil {
+		return
+	}
+	os.WriteFile(p, []byte(strings.Join(names, "\n")), 0600)
+}
+
+// remoteDir quotes dir for the remote shell, keeping ~ expandable.
+func remoteDir(dir string) string {
+	switch {
+	case dir == "":
+		return "."
+	case dir == "~/":
+		return `"$HOME"/`
+	case strings.HasPrefix(dir, "~/"):
+		return `"$HOME"/` + shellQuote(dir[2:])
+	}
+	return shellQuote(dir)
+}
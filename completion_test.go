@@ -0,0 +1,53 @@
+package sshw
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompleteRemotePath(t *testing.T) {
+	c := NewClient(newTestServer(t))
+	defer c.Close()
+
+	dir := t.TempDir()
+	assert.Nil(t, os.Mkdir(filepath.Join(dir, "logs"), 0755))
+	for _, name := range []string{"large.bin", "list.txt", ".local"} {
+		assert.Nil(t, os.WriteFile(filepath.Join(dir, name), nil, 0644))
+	}
+
+	entries, err := CompleteRemotePath(context.Background(), c, dir+"/l")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{dir + "/large.bin", dir + "/list.txt", dir + "/logs/"}, entries)
+
+	entries, err = CompleteRemotePath(context.Background(), c, dir+"/.l")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{dir + "/.local"}, entries)
+
+	entries, err = CompleteRemotePath(context.Background(), c, dir+"/missing/")
+	assert.Nil(t, err)
+	assert.Empty(t, entries)
+}
+
+func TestCompleteCache(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "complete", "dir")
+
+	_, ok := readCompleteCache(p)
+	assert.False(t, ok)
+
+	writeCompleteCache(p, []string{"logs/", "list.txt", "my file"})
+	names, ok := readCompleteCache(p)
+	assert.True(t, ok)
+	assert.Equal(t, []string{"logs/", "list.txt", "my file"}, names)
+	assert.Equal(t, []string{"/var/logs/", "/var/list.txt"}, matchNames(names, "/var/l"))
+
+	// outdated
+	old := time.Now().Add(-completeCacheTTL * 2)
+	assert.Nil(t, os.Chtimes(p, old, old))
+	_, ok = readCompleteCache(p)
+	assert.False(t, ok)
+}
@@ -0,0 +1,472 @@
+package sshw
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
+)
+
+// x/crypto/ssh has no transport compression, so scp and exec compress their
+// streams themselves, with the gzip or zstd command on the remote side.
+
+const (
+	compressionAuto = "auto"
+	compressionNo   = "no"
+)
+
+// codec is a compression that both sides can run.
+type codec struct {
+	name string
+	// the remote commands, reading stdin and writing stdout
+	compress   string
+	decompress string
+
+	local     func() bool
+	newWriter func(w io.Writer) (io.WriteCloser, error)
+	newReader func(r io.Reader) (io.ReadCloser, error)
+}
+
+// codecs are in the order auto prefers them.
+var codecs = []*codec{
+	{
+		name:       "zstd",
+		compress:   "zstd -qc",
+		decompress: "zstd -qdc",
+		local: func() bool {
+			_, err := exec.LookPath("zstd")
+			return err == nil
+		},
+		newWriter: func(w io.Writer) (io.WriteCloser, error) {
+			return newCommandWriter(w, "zstd", "-qc")
+		},
+		newReader: func(r io.Reader) (io.ReadCloser, error) {
+			return newCommandReader(r, "zstd", "-qdc")
+		},
+	},
+	{
+		name:       "gzip",
+		compress:   "gzip -c",
+		decompress: "gzip -dc",
+		local:      func() bool { return true },
+		newWriter: func(w io.Writer) (io.WriteCloser, error) {
+			return gzip.NewWriter(w), nil
+		},
+		newReader: func(r io.Reader) (io.ReadCloser, error) {
+			return gzip.NewReader(r)
+		},
+	},
+}
+
+func findCodec(name string) *codec {
+	for _, cd := range codecs {
+		if cd.name == name {
+			return cd
+		}
+	}
+	return nil
+}
+
+// codec returns the compression of the node, nil without one. With auto it is
+// the first of the codecs that both sides have, the host is asked once.
+func (c *defaultClient) codec() (*codec, error) {
+	switch c.node.Compression {
+	case "", compressionNo:
+		return nil, nil
+	case compressionAuto:
+	default:
+		cd := findCodec(c.node.Compression)
+		if cd == nil {
+			return nil, errors.Errorf("unknown compression : %s", c.node.Compression)
+		}
+		if !cd.local() {
+			return nil, errors.Errorf("compression %s is not installed", cd.name)
+		}
+		return cd, nil
+	}
+
+	if c.codecProbed {
+		return c.autoCodec, nil
+	}
+
+	session, err := c.client.NewSession()
+	if err != nil {
+		return nil, errors.Wrap(err, "new session fail")
+	}
+	defer session.Close()
+
+	var names []string
+	for _, cd := range codecs {
+		names = append(names, cd.name)
+	}
+	out, err := session.Output(fmt.Sprintf("for z in %s; do command -v $z >/dev/null 2>&1 && echo $z; done; true", strings.Join(names, " ")))
+	if err != nil {
+		return nil, errors.Wrap(err, "detect compression fail")
+	}
+	for _, name := range strings.Fields(string(out)) {
+		if cd := findCodec(name); cd != nil && cd.local() {
+			c.autoCodec = cd
+			break
+		}
+	}
+	c.codecProbed = true
+	return c.autoCodec, nil
+}
+
+// compressCommand runs cmd with its stdout compressed, and its stdin
+// decompressed when compressStdin is set. The exit status is the one of cmd.
+func (cd *codec) compressCommand(cmd string, compressStdin bool) string {
+	run := "(\n" + cmd + "\n)"
+	if compressStdin {
+		run = cd.decompress + " | " + run
+	}
+	// the status of cmd goes through fd 3, as a pipeline exits with the one of its last command
+	return fmt.Sprintf(`{ s=$( { { %s; echo $? >&3; } | %s >&4; } 3>&1 ); exit "$s"; } 4>&1`, run, cd.compress)
+}
+
+// compressStreams decompresses the stdout of the session, and compresses its
+// stdin when compressStdin is set. stop waits until the output is written,
+// after the session ended.
+func compressStreams(s *ssh.Session, cd *codec, compressStdin bool) (stop func() error) {
+	if compressStdin {
+		in := s.Stdin
+		pr, pw := io.Pipe()
+		go func() {
+			zw, err := cd.newWriter(pw)
+			if err == nil {
+				_, err = io.Copy(zw, in)
+				if cerr := zw.Close(); err == nil {
+					err = cerr
+				}
+			}
+			pw.CloseWithError(err)
+		}()
+		s.Stdin = pr
+	}
+
+	out := s.Stdout
+	pr, pw := io.Pipe()
+	s.Stdout = pw
+	done := make(chan error, 1)
+	go func() {
+		zr, err := cd.newReader(pr)
+		if err == nil {
+			_, err = io.Copy(out, zr)
+			if cerr := zr.Close(); err == nil {
+				err = cerr
+			}
+		}
+		// the session must not block on output nobody reads
+		io.Copy(io.Discard, pr)
+		done <- err
+	}()
+
+	return func() error {
+		pw.Close()
+		return errors.Wrap(<-done, "decompress fail")
+	}
+}
+
+// streamFromRemote downloads remotePath to localPath like CopyFromRemote, as a
+// compressed stream instead of with scp.
+func streamFromRemote(ctx context.Context, s *ssh.Session, cd *codec, remotePath string, localPath string, opt CopyOption) error {
+	f, err := os.CreateTemp(filepath.Dir(localPath), "."+filepath.Base(localPath)+".*.part")
+	if err != nil {
+		return errors.Wrap(err, "open file fail")
+	}
+	defer func() {
+		f.Close()
+		os.Remove(f.Name())
+	}()
+
+	var mode os.FileMode
+	var times FileTimes
+
+	wg := sync.WaitGroup{}
+	errCh := make(chan error, 1)
+	var stderr bytes.Buffer
+
+	wg.Add(1)
+	go func() {
+		var err error
+		defer func() {
+			wg.Done()
+			errCh <- err
+		}()
+
+		r, err := s.StdoutPipe()
+		if err != nil {
+			return
+		}
+		s.Stderr = &stderr
+
+		// a line of mode, size, mtime and atime with gnu or bsd stat, then the file
+		cmd := fmt.Sprintf(`f=%s; [ -f "$f" ] || { echo "$f: not a regular file" >&2; exit 1; }; `+
+			`stat -c '%%a %%s %%Y %%X' "$f" 2>/dev/null || stat -f '%%Lp %%z %%m %%a' "$f" || exit 1; %s < "$f"`,
+			shellQuote(remotePath), cd.compress)
+		err = s.Start(cmd)
+		if err != nil {
+			return
+		}
+
+		br := bufio.NewReader(r)
+		line, err := br.ReadString('\n')
+		if err != nil {
+			err = remoteError(s.Wait(), &stderr)
+			return
+		}
+		var size int64
+		mode, size, times, err = parseStat(line)
+		if err != nil {
+			return
+		}
+
+		// the limit is for the compressed bytes, the progress for the file
+		zr, err := cd.newReader(io.TeeReader(br, newRateWriter(ctx, io.Discard, opt.rateLimiter())))
+		if err != nil {
+			err = errors.Wrap(err, "decompress fail")
+			return
+		}
+		defer zr.Close()
+
+		bar, done := opt.bar("downloading ("+cd.name+") : "+path.Base(remotePath), size)
+		defer func() { done(err) }()
+		_, err = io.Copy(io.MultiWriter(f, bar), zr)
+		if err != nil {
+			err = errors.Wrap(err, "decompress fail")
+			return
+		}
+		err = zr.Close()
+		if err != nil {
+			return
+		}
+
+		err = remoteError(s.Wait(), &stderr)
+	}()
+
+	if err := wait(ctx, &wg); err != nil {
+		// closing the session unblocks the copy
+		s.Close()
+		return err
+	}
+	err = <-errCh
+	if err != nil {
+		return err
+	}
+
+	if !opt.Preserve {
+		return finishFile(f, localPath, 0644, nil)
+	}
+	return finishFile(f, localPath, mode, &times)
+}
+
+// parseStat parses the mode in octal, size, mtime and atime of a file.
+func parseStat(line string) (mode os.FileMode, size int64, times FileTimes, err error) {
+	parts := strings.Fields(line)
+	if len(parts) != 4 {
+		return 0, 0, times, errors.Errorf("unable to parse file stat : %s", line)
+	}
+
+	var v [4]int64
+	for i, p := range parts {
+		base := 10
+		if i == 0 {
+			base = 8
+		}
+		v[i], err = strconv.ParseInt(p, base, 64)
+		if err != nil {
+			return 0, 0, times, errors.Wrap(err, "parse file stat fail")
+		}
+	}
+	times = FileTimes{Mtime: time.Unix(v[2], 0), Atime: time.Unix(v[3], 0)}
+	return os.FileMode(v[0]).Perm(), v[1], times, nil
+}
+
+// partFile sets p to the file remotePath is uploaded to, see remoteTarget,
+// and t to the partial file it is written to first.
+func partFile(remotePath string) string {
+	return remoteTarget(remotePath) + `; t="$p.sshw-part"`
+}
+
+// streamFromLocal uploads localPath to remotePath like CopyFromLocal, as a
+// compressed stream instead of with scp.
+func streamFromLocal(ctx context.Context, s *ssh.Session, cd *codec, localPath string, remotePath string, opt CopyOption) error {
+	info, err := os.Stat(localPath)
+	if err != nil {
+		return errors.Wrap(err, "get file fail")
+	}
+	if info.IsDir() {
+		return errors.Errorf("can not send a dir : %s", localPath)
+	}
+
+	f, err := os.Open(localPath)
+	if err != nil {
+		return errors.Wrap(err, "open file fail")
+	}
+	defer f.Close()
+
+	// like scp, the mode is masked by the umask of the remote unless preserved
+	chmod := fmt.Sprintf(`chmod "$(printf %%o $((0%o & ~0$(umask))))" "$t"`, info.Mode().Perm())
+	if opt.Preserve {
+		chmod = fmt.Sprintf(`chmod %04o "$t" && TZ=UTC0 touch -t %s "$t"`, info.Mode().Perm(), info.ModTime().UTC().Format("200601021504.05"))
+	}
+	cmd := fmt.Sprintf(`%s; %s > "$t" && %s && mv -f "$t" "$p" || { rm -f "$t"; exit 1; }`,
+		partFile(remotePath), cd.decompress, chmod)
+
+	wg := sync.WaitGroup{}
+	errCh := make(chan error, 1)
+	var stderr bytes.Buffer
+
+	wg.Add(1)
+	go func() {
+		var err error
+		defer func() {
+			wg.Done()
+			errCh <- err
+		}()
+
+		w, err := s.StdinPipe()
+		if err != nil {
+			return
+		}
+		s.Stderr = &stderr
+
+		err = s.Start(cmd)
+		if err != nil {
+			return
+		}
+
+		zw, err := cd.newWriter(newRateWriter(ctx, w, opt.rateLimiter()))
+		if err != nil {
+			err = errors.Wrap(err, "compress fail")
+			return
+		}
+
+		bar, done := opt.bar("uploading ("+cd.name+") : "+info.Name(), info.Size())
+		defer func() { done(err) }()
+		_, err = io.CopyN(io.MultiWriter(zw, bar), f, info.Size())
+		if err == nil {
+			err = zw.Close()
+		}
+		w.Close()
+		if err != nil {
+			err = errors.Wrap(err, "compress fail")
+			return
+		}
+
+		err = remoteError(s.Wait(), &stderr)
+	}()
+
+	if err := wait(ctx, &wg); err != nil {
+		// closing the session unblocks the copy
+		s.Close()
+		return err
+	}
+	return <-errCh
+}
+
+// remoteError adds what the remote command printed to the error of its session.
+func remoteError(err error, stderr *bytes.Buffer) error {
+	if err == nil {
+		return nil
+	}
+	if msg := strings.TrimSpace(stderr.String()); msg != "" {
+		return errors.Wrap(err, msg)
+	}
+	return err
+}
+
+// commandWriter compresses what is written to it with a local command.
+type commandWriter struct {
+	io.WriteCloser
+	cmd *exec.Cmd
+}
+
+func newCommandWriter(w io.Writer, name string, args ...string) (io.WriteCloser, error) {
+	cmd := exec.Command(name, args...)
+	cmd.Stdout = w
+	cmd.Stderr = os.Stderr
+	in, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	err = cmd.Start()
+	if err != nil {
+		return nil, err
+	}
+	return &commandWriter{WriteCloser: in, cmd: cmd}, nil
+}
+
+// Close waits until the command wrote everything.
+func (c *commandWriter) Close() error {
+	c.WriteCloser.Close()
+	return c.cmd.Wait()
+}
+
+// commandReader decompresses what is read from r with a local command.
+type commandReader struct {
+	io.ReadCloser
+	cmd  *exec.Cmd
+	eof  bool
+	once sync.Once
+	err  error
+}
+
+func newCommandReader(r io.Reader, name string, args ...string) (io.ReadCloser, error) {
+	cmd := exec.Command(name, args...)
+	cmd.Stderr = os.Stderr
+	in, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	err = cmd.Start()
+	if err != nil {
+		return nil, err
+	}
+
+	// not cmd.Stdin, Wait would wait for r to end too
+	go func() {
+		io.Copy(in, r)
+		in.Close()
+	}()
+	return &commandReader{ReadCloser: out, cmd: cmd}, nil
+}
+
+func (c *commandReader) Read(b []byte) (int, error) {
+	n, err := c.ReadCloser.Read(b)
+	if err == io.EOF {
+		c.eof = true
+	}
+	return n, err
+}
+
+// Close reports a broken stream after everything was read, and stops the
+// command otherwise.
+func (c *commandReader) Close() error {
+	c.once.Do(func() {
+		if !c.eof {
+			c.cmd.Process.Kill()
+			c.cmd.Wait()
+			return
+		}
+		c.err = c.cmd.Wait()
+	})
+	return c.err
+}
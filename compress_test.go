@@ -0,0 +1,109 @@
+package sshw
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompressedScp(t *testing.T) {
+	for _, cd := range codecs {
+		if !cd.local() {
+			continue
+		}
+		t.Run(cd.name, func(t *testing.T) {
+			node := newTestServer(t)
+			node.Compression = cd.name
+			dir := t.TempDir()
+
+			src := filepath.Join(dir, "run.sh")
+			content := strings.Repeat("echo sshw\n", 10000)
+			assert.Nil(t, os.WriteFile(src, []byte(content), 0644))
+			assert.Nil(t, os.Chmod(src, 0750))
+			mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+			assert.Nil(t, os.Chtimes(src, mtime, mtime))
+
+			up := filepath.Join(dir, "up")
+			assert.Nil(t, os.Mkdir(up, 0755))
+			opt := CopyOption{Preserve: true}
+
+			// into a directory, it gets the name of the target like with scp
+			err := NewClient(node).Scp(context.Background(), ScpOption{SrcFilePath: src, TarHost: "test", TarFilePath: up, Verify: true, CopyOption: opt})
+			assert.Nil(t, err)
+			remote := filepath.Join(up, "up")
+
+			local := filepath.Join(dir, "local.sh")
+			err = NewClient(node).Scp(context.Background(), ScpOption{SrcHost: "test", SrcFilePath: remote, TarFilePath: local, Verify: true, CopyOption: opt})
+			assert.Nil(t, err)
+
+			for _, p := range []string{remote, local} {
+				info, err := os.Stat(p)
+				assert.Nil(t, err)
+				assert.Equal(t, os.FileMode(0750), info.Mode().Perm(), p)
+				assert.True(t, mtime.Equal(info.ModTime()), p)
+			}
+
+			err = NewClient(node).Scp(context.Background(), ScpOption{SrcHost: "test", SrcFilePath: filepath.Join(dir, "missing"), TarFilePath: local})
+			assert.ErrorContains(t, err, "not a regular file")
+		})
+	}
+}
+
+func TestCompressedScpCanceled(t *testing.T) {
+	node := newTestServer(t)
+	dir := t.TempDir()
+
+	c := genSSHConfig(node)
+	assert.Nil(t, c.connect(context.Background()))
+	defer c.Close()
+
+	src := filepath.Join(dir, "src.txt")
+	assert.Nil(t, os.WriteFile(src, []byte("hello sshw"), 0644))
+	tar := filepath.Join(dir, "tar.txt")
+	assert.Nil(t, os.WriteFile(tar, []byte("old"), 0644))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	// the existing target is left alone, only the partial file is removed
+	err := c.copyFile(ctx, codecs[len(codecs)-1], ScpOption{SrcFilePath: src, TarFilePath: tar})
+	assert.NotNil(t, err)
+	b, err := os.ReadFile(tar)
+	assert.Nil(t, err)
+	assert.Equal(t, "old", string(b))
+}
+
+func TestCompressCommand(t *testing.T) {
+	node := newTestServer(t)
+	c := genSSHConfig(node)
+	assert.Nil(t, c.connect(context.Background()))
+	defer c.Close()
+
+	node.Compression = compressionAuto
+	cd, err := c.codec()
+	assert.Nil(t, err)
+	assert.NotNil(t, cd)
+
+	s, err := c.client.NewSession()
+	assert.Nil(t, err)
+	defer s.Close()
+
+	var out bytes.Buffer
+	s.Stdin = strings.NewReader("hello sshw\n")
+	s.Stdout = &out
+	stop := compressStreams(s, cd, true)
+	err = s.Run(cd.compressCommand("tr a-z A-Z; exit 3", true))
+	assert.Nil(t, stop())
+	assert.Equal(t, "HELLO SSHW\n", out.String())
+	assert.Equal(t, &ExitError{Host: "test", Status: 3}, exitError("test", err))
+
+	node.Compression = "lz4"
+	_, err = c.codec()
+	assert.NotNil(t, err)
+}
@@ -6,11 +6,14 @@ import (
 	"os"
 	"os/user"
 	"path"
+	"path/filepath"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/atrox/homedir"
 	"github.com/kevinburke/ssh_config"
+	"github.com/pkg/errors"
 	"golang.org/x/crypto/ssh"
 	"gopkg.in/yaml.v2"
 )
@@ -19,6 +22,7 @@ type Node struct {
 	Name           string           `yaml:"name"`
 	Alias          string           `yaml:"alias"`
 	Host           string           `yaml:"host"`
+	Tags           []string         `yaml:"tags"`
 	User           string           `yaml:"user"`
 	Port           int              `yaml:"port"`
 	KeyPath        string           `yaml:"keypath"`
@@ -27,11 +31,97 @@ type Node struct {
 	CallbackShells []*CallbackShell `yaml:"callback-shells"`
 	Children       []*Node          `yaml:"children"`
 	Jump           []*Node          `yaml:"jump"`
+
+	// ServerAliveInterval is the keepalive interval in seconds, 0 means default, negative disables it.
+	ServerAliveInterval int `yaml:"server-alive-interval"`
+	// ServerAliveCountMax is how many keepalives may go unanswered before the connection is closed.
+	ServerAliveCountMax int `yaml:"server-alive-count-max"`
+
+	// KnownHosts is a known_hosts file to verify the host key against, no verification when empty.
+	KnownHosts string `yaml:"known-hosts"`
+
+	// Term overrides the terminal type, defaults to $TERM.
+	Term string `yaml:"term"`
+	// SendEnv lists local variables sent to the server, patterns like LC_* are allowed.
+	SendEnv []string `yaml:"send-env"`
+
+	// Multiplex shares one connection to the node between sshw processes through a background daemon.
+	Multiplex bool `yaml:"multiplex"`
+	// ControlPersist is how many seconds the shared connection stays open when unused, defaults to 600.
+	ControlPersist int `yaml:"control-persist"`
+
+	// Proxy is a socks5:// or http:// url the first hop is connected through,
+	// "direct" ignores the proxy of the config.
+	Proxy string `yaml:"proxy"`
+	// ProxyCommand connects the first hop through the stdin and stdout of a command
+	// instead, e.g. "nc %h %p", where %h, %p and %r are its host, port and user.
+	ProxyCommand string `yaml:"proxy-command"`
+
+	// Limit is the bandwidth of scp, e.g. 5MB/s, unlimited when empty.
+	Limit string `yaml:"limit"`
+	// Compression compresses the streams of scp and exec with gzip or zstd, auto
+	// picks one that the host has. The ssh transport itself is not compressed.
+	Compression string `yaml:"compression"`
+
+	Reconnect *ReconnectOption `yaml:"reconnect"`
+	Record    *RecordOption    `yaml:"record"`
+
+	// inherited are the tags of the parent groups
+	inherited []string
+}
+
+// ReconnectOption enables automatic reconnect of interactive sessions.
+type ReconnectOption struct {
+	// MaxRetries limits reconnect attempts, 0 means retry until canceled.
+	MaxRetries int `yaml:"max-retries"`
+	// Attach is the terminal multiplexer to reattach after login, tmux or screen.
+	Attach string `yaml:"attach"`
+	// Session is the multiplexer session name, defaults to the node name.
+	Session string `yaml:"session"`
+}
+
+// RecordOption enables recording of interactive sessions as asciicast v2 files.
+type RecordOption struct {
+	// Dir is where recordings are stored, defaults to ~/.sshw.d/records.
+	Dir string `yaml:"dir"`
+	// Input records keystrokes too, note that this includes typed passwords.
+	Input bool `yaml:"input"`
+}
+
+func (o *ReconnectOption) attachCmd(n *Node) string {
+	name := o.Session
+	if name == "" {
+		name = strings.NewReplacer(".", "_", ":", "_").Replace(n.Name)
+	}
+
+	switch o.Attach {
+	case "tmux":
+		return "tmux new-session -A -s " + shellQuote(name)
+	case "screen":
+		return "screen -xRR " + shellQuote(name)
+	}
+	return ""
 }
 
 type CallbackShell struct {
 	Cmd   string        `yaml:"cmd"`
 	Delay time.Duration `yaml:"delay"`
+
+	// Expect is a regexp the session output must match before Cmd is sent.
+	Expect string `yaml:"expect"`
+	// Timeout in milliseconds to wait for Expect, defaults to 10s.
+	Timeout time.Duration `yaml:"timeout"`
+	// OnTimeout is what to do when Expect never matches: fail (default), send or skip.
+	OnTimeout string `yaml:"on-timeout"`
+	// Secret sends a value from env:NAME, file:PATH or cmd:COMMAND instead of Cmd.
+	Secret string `yaml:"secret"`
+}
+
+func (s *CallbackShell) timeout() time.Duration {
+	if s.Timeout <= 0 {
+		return defaultExpectTimeout
+	}
+	return s.Timeout * time.Millisecond
 }
 
 func (n *Node) String() string {
@@ -52,6 +142,61 @@ func (n *Node) port() int {
 	return n.Port
 }
 
+func (n *Node) term() string {
+	if n.Term != "" {
+		return n.Term
+	}
+	if t := os.Getenv("TERM"); t != "" {
+		return t
+	}
+	return "xterm"
+}
+
+// env returns the local variables matching SendEnv as name value pairs.
+func (n *Node) env() [][2]string {
+	patterns := n.SendEnv
+	if patterns == nil {
+		patterns = defaultSendEnv
+	}
+
+	var env [][2]string
+	for _, kv := range os.Environ() {
+		k, v, _ := strings.Cut(kv, "=")
+		for _, p := range patterns {
+			if ok, _ := path.Match(p, k); ok {
+				env = append(env, [2]string{k, v})
+				break
+			}
+		}
+	}
+	return env
+}
+
+func (n *Node) serverAliveInterval() time.Duration {
+	if n.ServerAliveInterval == 0 {
+		return defaultServerAliveInterval
+	}
+	if n.ServerAliveInterval < 0 {
+		return 0
+	}
+	return time.Duration(n.ServerAliveInterval) * time.Second
+}
+
+func (n *Node) serverAliveCountMax() int {
+	if n.ServerAliveCountMax <= 0 {
+		return defaultServerAliveCountMax
+	}
+	return n.ServerAliveCountMax
+}
+
+// keyPath returns the private key of the node, ~/.ssh/id_rsa by default.
+func (n *Node) keyPath() (string, error) {
+	if n.KeyPath == "" {
+		return homedir.Expand("~/.ssh/id_rsa")
+	}
+	return homedir.Expand(n.KeyPath)
+}
+
 func (n *Node) password() ssh.AuthMethod {
 	if n.Password == "" {
 		return nil
@@ -63,44 +208,278 @@ func (n *Node) alias() string {
 	return n.Alias
 }
 
+// dataDir is where sshw keeps its own files, ~/.sshw is the config.
+const dataDir = "~/.sshw.d"
+
+const (
+	defaultServerAliveInterval = time.Second * 10
+	defaultServerAliveCountMax = 3
+	defaultExpectTimeout       = time.Second * 10
+)
+
 var (
-	config []*Node
+	defaultSendEnv = []string{"LANG", "LC_*"}
+
+	errFound = errors.New("found")
+
+	// SkipChildren is returned by a WalkFunc to skip the children of a group.
+	SkipChildren = errors.New("skip children")
 )
 
-func GetConfig() []*Node {
-	return config
+// Config is the tree of nodes sshw can connect to.
+type Config struct {
+	Nodes []*Node
+
+	// DisableHistory stops sshw from writing its commands to the shell history.
+	DisableHistory bool
+	// Proxy is the proxy of nodes without one, see Node.Proxy.
+	Proxy string
+}
+
+// configFile is the config with settings, a config of only nodes can be the list of nodes.
+type configFile struct {
+	DisableHistory bool    `yaml:"disable-history"`
+	Proxy          string  `yaml:"proxy"`
+	Nodes          []*Node `yaml:"nodes"`
 }
 
-func LoadConfig() error {
-	b, err := LoadConfigBytes(".sshw", ".sshw.yml", ".sshw.yaml")
+// WalkFunc is called for every node with its parent groups, outermost first.
+type WalkFunc func(node *Node, parents []*Node) error
+
+var configNames = []string{".sshw", ".sshw.yml", ".sshw.yaml"}
+
+// LoadConfig loads the first sshw config found in the home or current directory.
+func LoadConfig() (*Config, error) {
+	b, err := LoadConfigBytes(configNames...)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	var c []*Node
-	err = yaml.Unmarshal(b, &c)
+	return ParseConfig(b)
+}
+
+// ConfigPath returns the path of the config LoadConfig loads.
+func ConfigPath() (string, error) {
+	return findConfig(configNames...)
+}
+
+// ParseConfig parses a yaml sshw config, either a list of nodes or a map of
+// settings with the nodes under "nodes".
+func ParseConfig(b []byte) (*Config, error) {
+	c, err := parseConfig(b)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	return c, c.validate()
+}
 
-	config = c
+func parseConfig(b []byte) (*Config, error) {
+	var nodes []*Node
+	err := yaml.Unmarshal(b, &nodes)
+	if err == nil {
+		return NewConfig(nodes), nil
+	}
+
+	var f configFile
+	if yaml.Unmarshal(b, &f) != nil {
+		return nil, err
+	}
+	c := NewConfig(f.Nodes)
+	c.DisableHistory = f.DisableHistory
+	c.Proxy = f.Proxy
+	if c.Proxy != "" {
+		c.Walk(func(node *Node, parents []*Node) error {
+			if node.Proxy == "" {
+				node.Proxy = c.Proxy
+			}
+			return nil
+		})
+	}
+	return c, nil
+}
+
+// validate checks the settings that are only used once connected.
+func (c *Config) validate() error {
+	return c.Walk(func(node *Node, parents []*Node) error {
+		for i, shell := range node.CallbackShells {
+			switch shell.OnTimeout {
+			case "", "fail", "send", "skip":
+			default:
+				return errors.Errorf("node %s: callback shell %d: unknown on-timeout %q", node.Name, i+1, shell.OnTimeout)
+			}
+		}
+		return nil
+	})
+}
 
+// NewConfig creates a config of nodes, children inherit the tags of their groups.
+func NewConfig(nodes []*Node) *Config {
+	c := &Config{Nodes: nodes}
+	c.Walk(func(node *Node, parents []*Node) error {
+		node.inherited = nil
+		if len(parents) > 0 {
+			node.inherited = parents[len(parents)-1].AllTags()
+		}
+		return nil
+	})
+	return c
+}
+
+// Walk calls fn for every node depth first, stopping at the first error fn
+// returns other than SkipChildren.
+func (c *Config) Walk(fn WalkFunc) error {
+	return walk(c.Nodes, nil, fn)
+}
+
+func walk(nodes []*Node, parents []*Node, fn WalkFunc) error {
+	for _, node := range nodes {
+		err := fn(node, parents)
+		if err == SkipChildren {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		if len(node.Children) > 0 {
+			// copy so that fn may keep parents
+			p := append(append(make([]*Node, 0, len(parents)+1), parents...), node)
+			err = walk(node.Children, p, fn)
+			if err != nil {
+				return err
+			}
+		}
+	}
 	return nil
 }
 
-func LoadSshConfig() error {
+// Lookup finds a node by name, then by alias, then by host.
+func (c *Config) Lookup(nameOrAliasOrHost string) *Node {
+	for _, match := range []func(*Node) bool{
+		func(n *Node) bool { return n.Name == nameOrAliasOrHost },
+		func(n *Node) bool { return n.Alias != "" && n.Alias == nameOrAliasOrHost },
+		func(n *Node) bool { return n.Host != "" && n.Host == nameOrAliasOrHost },
+	} {
+		if node := c.find(match); node != nil {
+			return node
+		}
+	}
+	return nil
+}
+
+func (c *Config) find(match func(*Node) bool) *Node {
+	var found *Node
+	c.Walk(func(node *Node, parents []*Node) error {
+		if match(node) {
+			found = node
+			return errFound
+		}
+		return nil
+	})
+	return found
+}
+
+// Filter returns the hosts tagged with tag.
+func (c *Config) Filter(tag string) []*Node {
+	return c.Select(tag)
+}
+
+// Select returns the hosts matching a tag selector. The selector is a comma
+// separated list of terms that all have to match, a term is a tag, tags
+// separated by | of which one has to match, or a tag prefixed with ! that
+// must not be present. e.g. "prod,db|cache,!eu-west".
+func (c *Config) Select(selector string) []*Node {
+	var terms [][]string
+	for _, term := range strings.Split(selector, ",") {
+		term = strings.TrimSpace(term)
+		if term != "" {
+			terms = append(terms, strings.Split(term, "|"))
+		}
+	}
+
+	var nodes []*Node
+	c.Walk(func(node *Node, parents []*Node) error {
+		if node.Host != "" && !node.IsPattern() && node.matchTags(terms) {
+			nodes = append(nodes, node)
+		}
+		return nil
+	})
+	return nodes
+}
+
+func (n *Node) matchTags(terms [][]string) bool {
+	for _, term := range terms {
+		match := false
+		for _, tag := range term {
+			tag = strings.TrimSpace(tag)
+			if strings.HasPrefix(tag, "!") {
+				match = !n.HasTag(tag[1:])
+			} else {
+				match = n.HasTag(tag)
+			}
+			if match {
+				break
+			}
+		}
+		if !match {
+			return false
+		}
+	}
+	return true
+}
+
+// HasTag reports whether the node or one of its groups is tagged with tag.
+func (n *Node) HasTag(tag string) bool {
+	for _, t := range n.AllTags() {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// AllTags returns the tags of the node, including the ones inherited from its groups.
+func (n *Node) AllTags() []string {
+	if len(n.inherited) == 0 {
+		return n.Tags
+	}
+
+	tags := append([]string(nil), n.inherited...)
+	for _, t := range n.Tags {
+		found := false
+		for _, i := range n.inherited {
+			if i == t {
+				found = true
+				break
+			}
+		}
+		if !found {
+			tags = append(tags, t)
+		}
+	}
+	return tags
+}
+
+// LoadSshConfig loads the hosts of ~/.ssh/config.
+func LoadSshConfig() (*Config, error) {
 	u, err := user.Current()
 	if err != nil {
-		l.Error(err)
-		return nil
+		return nil, err
+	}
+	f, err := os.Open(path.Join(u.HomeDir, ".ssh/config"))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	cfg, err := ssh_config.Decode(f)
+	if err != nil {
+		return nil, err
 	}
-	f, _ := os.Open(path.Join(u.HomeDir, ".ssh/config"))
-	cfg, _ := ssh_config.Decode(f)
 	var nc []*Node
 	for _, host := range cfg.Hosts {
 		alias := fmt.Sprintf("%s", host.Patterns[0])
 		hostName, err := cfg.Get(alias, "HostName")
 		if err != nil {
-			return err
+			return nil, err
 		}
 		if hostName != "" {
 			port, _ := cfg.Get(alias, "Port")
@@ -115,32 +494,46 @@ func LoadSshConfig() error {
 			c.Port, _ = strconv.Atoi(port)
 			keyPath, _ := cfg.Get(alias, "IdentityFile")
 			c.KeyPath, _ = homedir.Expand(keyPath)
+			if proxyCommand, _ := cfg.Get(alias, "ProxyCommand"); proxyCommand != "none" {
+				c.ProxyCommand = proxyCommand
+			}
 			nc = append(nc, c)
 			// fmt.Println(c.Alias, c.Host, c.User, c.Port, c.KeyPath)
 		}
 	}
-	config = nc
-	return nil
+	return NewConfig(nc), nil
 }
 
 func LoadConfigBytes(names ...string) ([]byte, error) {
-	u, err := user.Current()
+	p, err := findConfig(names...)
 	if err != nil {
 		return nil, err
 	}
+	return ioutil.ReadFile(p)
+}
+
+func findConfig(names ...string) (string, error) {
+	u, err := user.Current()
+	if err != nil {
+		return "", err
+	}
 	// homedir
 	for i := range names {
-		sshw, err := ioutil.ReadFile(path.Join(u.HomeDir, names[i]))
-		if err == nil {
-			return sshw, nil
+		p := path.Join(u.HomeDir, names[i])
+		if isFile(p) {
+			return p, nil
 		}
 	}
 	// relative
 	for i := range names {
-		sshw, err := ioutil.ReadFile(names[i])
-		if err == nil {
-			return sshw, nil
+		if isFile(names[i]) {
+			return filepath.Abs(names[i])
 		}
 	}
-	return nil, err
+	return "", errors.Errorf("no config found : %s", strings.Join(names, ", "))
+}
+
+func isFile(p string) bool {
+	fi, err := os.Stat(p)
+	return err == nil && !fi.IsDir()
 }
@@ -0,0 +1,126 @@
+package sshw
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/atrox/homedir"
+	"github.com/stretchr/testify/assert"
+)
+
+const testConfig = `
+- { name: dev, alias: d, host: 192.168.8.35, tags: [dev] }
+- name: group
+  tags: [eu-west]
+  children:
+  - { name: db, host: 192.168.1.2, tags: [prod, db] }
+  - name: nested
+    children:
+    - { name: web, alias: w, host: 192.168.1.3, tags: [prod] }
+`
+
+func TestConfigLookup(t *testing.T) {
+	c, err := ParseConfig([]byte(testConfig))
+	assert.Nil(t, err)
+
+	assert.Equal(t, "dev", c.Lookup("d").Name)
+	assert.Equal(t, "web", c.Lookup("w").Name)
+	assert.Equal(t, "db", c.Lookup("192.168.1.2").Name)
+	assert.Equal(t, "nested", c.Lookup("nested").Name)
+	assert.Nil(t, c.Lookup("unknown"))
+}
+
+func TestConfigWalk(t *testing.T) {
+	c, err := ParseConfig([]byte(testConfig))
+	assert.Nil(t, err)
+
+	var paths []string
+	c.Walk(func(node *Node, parents []*Node) error {
+		p := ""
+		for _, parent := range parents {
+			p += parent.Name + "/"
+		}
+		paths = append(paths, p+node.Name)
+		if node.Name == "nested" {
+			return SkipChildren
+		}
+		return nil
+	})
+	assert.Equal(t, []string{"dev", "group", "group/db", "group/nested"}, paths)
+
+	var names []string
+	for _, n := range c.Filter("prod") {
+		names = append(names, n.Name)
+	}
+	assert.Equal(t, []string{"db", "web"}, names)
+}
+
+func TestConfigSelect(t *testing.T) {
+	c, err := ParseConfig([]byte(testConfig))
+	assert.Nil(t, err)
+
+	assert.Equal(t, []string{"eu-west", "prod"}, c.Lookup("web").AllTags())
+
+	names := func(nodes []*Node) []string {
+		var s []string
+		for _, n := range nodes {
+			s = append(s, n.Name)
+		}
+		return s
+	}
+
+	assert.Equal(t, []string{"db", "web"}, names(c.Select("eu-west")))
+	assert.Equal(t, []string{"db"}, names(c.Select("prod,db")))
+	assert.Equal(t, []string{"dev", "db"}, names(c.Select("dev|db")))
+	assert.Equal(t, []string{"web"}, names(c.Select("prod,!db")))
+	assert.Empty(t, c.Select("stage"))
+}
+
+func TestParseConfigSettings(t *testing.T) {
+	c, err := ParseConfig([]byte("disable-history: true\nnodes:\n- { name: dev, host: 192.168.8.35 }\n"))
+	assert.Nil(t, err)
+	assert.True(t, c.DisableHistory)
+	assert.Equal(t, "dev", c.Lookup("dev").Name)
+
+	_, err = ParseConfig([]byte("- name: [dev"))
+	assert.NotNil(t, err)
+
+	_, err = ParseConfig([]byte("- { name: dev, callback-shells: [{ cmd: ls, on-timeout: skip }] }"))
+	assert.Nil(t, err)
+	_, err = ParseConfig([]byte("- name: group\n  children:\n  - { name: dev, callback-shells: [{ cmd: ls, on-timeout: ignore }] }"))
+	assert.NotNil(t, err)
+}
+
+func TestNodeEnv(t *testing.T) {
+	t.Setenv("LANG", "en_US.UTF-8")
+	t.Setenv("LC_TIME", "de_DE.UTF-8")
+	t.Setenv("SSHW_TEST_TOKEN", "secret")
+
+	// only the locale by default
+	env := (&Node{}).env()
+	assert.Contains(t, env, [2]string{"LANG", "en_US.UTF-8"})
+	assert.Contains(t, env, [2]string{"LC_TIME", "de_DE.UTF-8"})
+	assert.NotContains(t, env, [2]string{"SSHW_TEST_TOKEN", "secret"})
+
+	env = (&Node{SendEnv: []string{"SSHW_TEST_*"}}).env()
+	assert.Equal(t, [][2]string{{"SSHW_TEST_TOKEN", "secret"}}, env)
+
+	assert.Empty(t, (&Node{SendEnv: []string{}}).env())
+}
+
+func TestNodeKeyPath(t *testing.T) {
+	home, err := homedir.Dir()
+	assert.Nil(t, err)
+
+	p, err := (&Node{KeyPath: "~/.ssh/internal"}).keyPath()
+	assert.Nil(t, err)
+	assert.Equal(t, filepath.Join(home, ".ssh", "internal"), p)
+
+	p, err = (&Node{}).keyPath()
+	assert.Nil(t, err)
+	assert.Equal(t, filepath.Join(home, ".ssh", "id_rsa"), p)
+
+	p, err = (&Node{KeyPath: "/etc/ssh/key"}).keyPath()
+	assert.Nil(t, err)
+	assert.Equal(t, "/etc/ssh/key", p)
+}
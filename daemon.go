@@ -0,0 +1,625 @@
+package sshw
+
+import (
+	"bufio"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/atrox/homedir"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
+)
+
+// The daemon keeps one ssh connection per node and shares it between sshw
+// processes, like ControlMaster of openssh. A process connects to the unix
+// socket, sends the node it wants as a json line and then runs an ssh
+// handshake over the socket. Every channel it opens is bridged to a channel
+// on the daemon's connection to the node.
+
+const (
+	defaultControlPersist = time.Minute * 10
+	daemonIdleTimeout     = time.Minute
+	daemonStartTimeout    = time.Second * 3
+)
+
+// DaemonCommand starts the daemon when it is not running, sshw sets it to its
+// own daemon command. Without it, a program using the package runs a Daemon
+// itself, or nodes with multiplex connect directly.
+var DaemonCommand []string
+
+type daemonRequest struct {
+	Node *Node `json:"node"`
+}
+
+type daemonResponse struct {
+	Error string `json:"error,omitempty"`
+}
+
+func daemonSocketPath() (string, error) {
+	if p := os.Getenv("SSHW_DAEMON_SOCKET"); p != "" {
+		return p, nil
+	}
+
+	dir, err := homedir.Expand(dataDir)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "daemon.sock"), nil
+}
+
+// key identifies the connection of a node, including its jump hosts. Nodes
+// share a connection only when they log in with the same credentials and take
+// the same route, the credentials are in it as a hash so that it can be logged.
+func (n *Node) key() string {
+	keyPath, _ := n.keyPath()
+	h := sha256.New()
+	for _, s := range []string{keyPath, n.Passphrase, n.Password, n.Proxy, n.ProxyCommand} {
+		fmt.Fprintf(h, "%d:%s", len(s), s)
+	}
+
+	k := fmt.Sprintf("%s@%s (%x)", n.user(), net.JoinHostPort(n.Host, strconv.Itoa(n.port())), h.Sum(nil)[:6])
+	for _, j := range n.Jump {
+		k += " via " + j.key()
+	}
+	return k
+}
+
+func (n *Node) controlPersist() time.Duration {
+	if n.ControlPersist <= 0 {
+		return defaultControlPersist
+	}
+	return time.Duration(n.ControlPersist) * time.Second
+}
+
+// dialDaemon returns a client whose channels are opened on the daemon's
+// connection to the node, starting the daemon when it is not running.
+func dialDaemon(ctx context.Context, node *Node) (*ssh.Client, error) {
+	p, err := daemonSocketPath()
+	if err != nil {
+		return nil, err
+	}
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "unix", p)
+	if err != nil {
+		err = startDaemon()
+		if err != nil {
+			return nil, errors.Wrap(err, "start daemon fail")
+		}
+
+		deadline := time.Now().Add(daemonStartTimeout)
+		for time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond * 100)
+			conn, err = d.DialContext(ctx, "unix", p)
+			if err == nil || ctx.Err() != nil {
+				break
+			}
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "connect daemon fail")
+		}
+	}
+
+	n := *node
+	n.Children = nil
+	n.CallbackShells = nil
+	b, err := json.Marshal(daemonRequest{Node: &n})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	_, err = conn.Write(append(b, '\n'))
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	// read byte by byte, the ssh handshake follows the response line
+	line, err := readLine(conn)
+	if err != nil {
+		conn.Close()
+		return nil, errors.Wrap(err, "read daemon response fail")
+	}
+	var res daemonResponse
+	err = json.Unmarshal(line, &res)
+	if err != nil {
+		conn.Close()
+		return nil, errors.Wrap(err, "parse daemon response fail")
+	}
+	if res.Error != "" {
+		conn.Close()
+		return nil, errors.New(res.Error)
+	}
+
+	return handshake(ctx, conn, p, &ssh.ClientConfig{
+		User: "sshw",
+		// the daemon only serves the user, see checkPeer
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+}
+
+func readLine(r io.Reader) ([]byte, error) {
+	var line []byte
+	b := make([]byte, 1)
+	for {
+		_, err := r.Read(b)
+		if err != nil {
+			return nil, err
+		}
+		if b[0] == '\n' {
+			return line, nil
+		}
+		line = append(line, b[0])
+	}
+}
+
+func startDaemon() error {
+	if len(DaemonCommand) == 0 {
+		return errors.New("no daemon is running and no DaemonCommand to start one")
+	}
+
+	dir, err := homedir.Expand(dataDir)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(dir, 0700)
+	if err != nil {
+		return err
+	}
+
+	logFile, err := os.OpenFile(filepath.Join(dir, "daemon.log"), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer logFile.Close()
+
+	cmd := exec.Command(DaemonCommand[0], DaemonCommand[1:]...)
+	cmd.Stdout = logFile
+	cmd.Stderr = logFile
+	cmd.SysProcAttr = daemonSysProcAttr()
+
+	err = cmd.Start()
+	if err != nil {
+		return err
+	}
+	return cmd.Process.Release()
+}
+
+// Daemon shares ssh connections between sshw processes.
+type Daemon struct {
+	config *ssh.ServerConfig
+
+	mu        sync.Mutex
+	upstreams map[string]*upstream
+	conns     int
+	idleSince time.Time
+}
+
+// upstream is a connection to a node shared by the daemon's clients.
+type upstream struct {
+	key   string
+	ready chan struct{}
+	err   error
+
+	// set once connected, under the mutex of the daemon
+	client  *ssh.Client
+	jump    *ssh.Client
+	conns   map[*ssh.ServerConn]struct{}
+	idle    *time.Timer
+	persist time.Duration
+}
+
+func NewDaemon() (*Daemon, error) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &ssh.ServerConfig{NoClientAuth: true}
+	config.AddHostKey(signer)
+
+	return &Daemon{
+		config:    config,
+		upstreams: make(map[string]*upstream),
+		idleSince: time.Now(),
+	}, nil
+}
+
+// ListenAndServe serves the daemon socket until ctx is done, or it has been
+// idle without any connection for a while.
+func (d *Daemon) ListenAndServe(ctx context.Context) error {
+	p, err := daemonSocketPath()
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(p), 0700)
+	if err != nil {
+		return err
+	}
+
+	if conn, err := net.Dial("unix", p); err == nil {
+		conn.Close()
+		return errors.New("daemon is already running")
+	}
+	// a stale socket of a daemon that died
+	os.Remove(p)
+
+	ln, err := net.Listen("unix", p)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(p)
+	// the connections of the user are served without authentication, so
+	// only the user may connect, whatever the umask or the directory
+	err = os.Chmod(p, 0600)
+	if err != nil {
+		ln.Close()
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	go func() {
+		ticker := time.NewTicker(time.Second * 10)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				ln.Close()
+				return
+			case <-ticker.C:
+				if d.idle() {
+					l.Info("daemon idle, exit")
+					cancel()
+				}
+			}
+		}
+	}()
+
+	l.Infof("daemon listening on %s", p)
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				d.closeAll()
+				return nil
+			}
+			return err
+		}
+		go d.serve(ctx, conn)
+	}
+}
+
+func (d *Daemon) idle() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.conns == 0 && len(d.upstreams) == 0 && time.Since(d.idleSince) > daemonIdleTimeout
+}
+
+func (d *Daemon) closeAll() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, u := range d.upstreams {
+		u.close()
+	}
+}
+
+// close closes the clients of u and then its connection, the daemon's mutex
+// is held.
+func (u *upstream) close() {
+	for sconn := range u.conns {
+		sconn.Close()
+	}
+	if u.client != nil {
+		u.client.Close()
+	}
+	if u.jump != nil {
+		u.jump.Close()
+	}
+}
+
+func (d *Daemon) serve(ctx context.Context, conn net.Conn) {
+	d.mu.Lock()
+	d.conns++
+	d.mu.Unlock()
+	defer func() {
+		d.mu.Lock()
+		d.conns--
+		d.idleSince = time.Now()
+		d.mu.Unlock()
+	}()
+
+	reply := func(err error) error {
+		var res daemonResponse
+		if err != nil {
+			res.Error = err.Error()
+		}
+		b, _ := json.Marshal(res)
+		_, werr := conn.Write(append(b, '\n'))
+		return werr
+	}
+
+	err := checkPeer(conn)
+	if err != nil {
+		l.Error(err)
+		conn.Close()
+		return
+	}
+
+	line, err := bufio.NewReader(io.LimitReader(conn, 1<<20)).ReadBytes('\n')
+	if err != nil {
+		conn.Close()
+		return
+	}
+	var req daemonRequest
+	err = json.Unmarshal(line, &req)
+	if err != nil || req.Node == nil {
+		reply(errors.New("bad request"))
+		conn.Close()
+		return
+	}
+
+	u, err := d.upstream(ctx, req.Node)
+	if err != nil {
+		reply(err)
+		conn.Close()
+		return
+	}
+	if reply(nil) != nil {
+		conn.Close()
+		d.release(u, nil)
+		return
+	}
+
+	sconn, chans, reqs, err := ssh.NewServerConn(conn, d.config)
+	if err != nil {
+		conn.Close()
+		d.release(u, nil)
+		return
+	}
+	d.attach(u, sconn)
+	defer d.release(u, sconn)
+
+	go func() {
+		for req := range reqs {
+			// keepalives are answered here, the daemon watches the node itself
+			if req.WantReply {
+				req.Reply(req.Type == "keepalive@openssh.com", nil)
+			}
+		}
+	}()
+
+	for nc := range chans {
+		go bridgeChannel(u.client, nc)
+	}
+}
+
+// checkPeer rejects connections of other users than the one of the daemon.
+func checkPeer(conn net.Conn) error {
+	uc, ok := conn.(*net.UnixConn)
+	if !ok {
+		return errors.New("not a unix socket")
+	}
+	uid, err := peerUID(uc)
+	if err != nil {
+		return errors.Wrap(err, "get peer credentials fail")
+	}
+	if uid != os.Getuid() {
+		return errors.Errorf("connection of user %d rejected", uid)
+	}
+	return nil
+}
+
+// upstream returns the shared connection of node, connecting on first use.
+// The caller holds a reference until release.
+func (d *Daemon) upstream(ctx context.Context, node *Node) (*upstream, error) {
+	key := node.key()
+
+	d.mu.Lock()
+	u, ok := d.upstreams[key]
+	if !ok {
+		u = &upstream{
+			key:     key,
+			ready:   make(chan struct{}),
+			conns:   make(map[*ssh.ServerConn]struct{}),
+			persist: node.controlPersist(),
+		}
+		d.upstreams[key] = u
+	}
+	if u.idle != nil {
+		// the timer may be firing already, it checks u.idle
+		u.idle.Stop()
+		u.idle = nil
+	}
+	d.mu.Unlock()
+
+	if !ok {
+		go d.connect(ctx, u, node)
+	}
+
+	select {
+	case <-u.ready:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	if u.err != nil {
+		d.mu.Lock()
+		if d.upstreams[key] == u {
+			delete(d.upstreams, key)
+		}
+		d.mu.Unlock()
+		return nil, u.err
+	}
+	return u, nil
+}
+
+func (d *Daemon) connect(ctx context.Context, u *upstream, node *Node) {
+	defer close(u.ready)
+
+	// the daemon has no terminal, so only credentials from the config can be used
+	node.Multiplex = false
+	c := genSSHConfig(node)
+
+	ctx, cancel := context.WithTimeout(ctx, c.clientConfig.Timeout*2)
+	defer cancel()
+
+	u.err = c.connect(ctx)
+	if u.err != nil {
+		l.Errorf("connect %s fail : %s", u.key, u.err)
+		return
+	}
+	// c.Close is never called, it would drop the client other goroutines use
+	d.mu.Lock()
+	u.client, u.jump = c.client, c.jumpClient
+	d.mu.Unlock()
+	l.Infof("connected %s", u.key)
+
+	go func() {
+		done := make(chan struct{})
+		go func() {
+			u.client.Wait()
+			close(done)
+		}()
+
+		if interval := node.serverAliveInterval(); interval > 0 {
+			// it closes the connection when the node stops answering
+			err := c.keepalive(u.client, done, interval, node.serverAliveCountMax())
+			if err != nil {
+				l.Error(err)
+			}
+		}
+		<-done
+
+		// the node is gone, drop its clients so they can reconnect
+		d.mu.Lock()
+		if d.upstreams[u.key] == u {
+			delete(d.upstreams, u.key)
+		}
+		u.close()
+		d.mu.Unlock()
+		l.Infof("disconnected %s", u.key)
+	}()
+}
+
+func (d *Daemon) attach(u *upstream, sconn *ssh.ServerConn) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	u.conns[sconn] = struct{}{}
+}
+
+// release drops a client of u, the connection is closed when it had no
+// clients for its ControlPersist time.
+func (d *Daemon) release(u *upstream, sconn *ssh.ServerConn) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if sconn != nil {
+		delete(u.conns, sconn)
+	}
+	if len(u.conns) > 0 || u.idle != nil {
+		return
+	}
+
+	var t *time.Timer
+	t = time.AfterFunc(u.persist, func() {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+
+		if u.idle != t || d.upstreams[u.key] != u {
+			return
+		}
+		delete(d.upstreams, u.key)
+		d.idleSince = time.Now()
+		u.close()
+		l.Infof("closed idle %s", u.key)
+	})
+	u.idle = t
+}
+
+// bridgeChannel opens the same channel on upstream and copies data and
+// requests both ways until both sides are closed.
+func bridgeChannel(upstream *ssh.Client, nc ssh.NewChannel) {
+	up, upReqs, err := upstream.OpenChannel(nc.ChannelType(), nc.ExtraData())
+	if err != nil {
+		var openErr *ssh.OpenChannelError
+		if errors.As(err, &openErr) {
+			nc.Reject(openErr.Reason, openErr.Message)
+		} else {
+			nc.Reject(ssh.ConnectionFailed, err.Error())
+		}
+		return
+	}
+	defer up.Close()
+
+	ch, chReqs, err := nc.Accept()
+	if err != nil {
+		return
+	}
+
+	// a request of the client is answered before the requests of the upstream
+	// it caused, like exit-status, and before the channel is closed
+	var mu sync.Mutex
+	defer func() {
+		mu.Lock()
+		ch.Close()
+		mu.Unlock()
+	}()
+
+	go func() {
+		io.Copy(up, ch)
+		up.CloseWrite()
+	}()
+
+	go forwardRequests(up, chReqs, &mu)
+
+	var wg sync.WaitGroup
+	wg.Add(3)
+	go func() {
+		defer wg.Done()
+		io.Copy(ch, up)
+		ch.CloseWrite()
+	}()
+	go func() {
+		defer wg.Done()
+		io.Copy(ch.Stderr(), up.Stderr())
+	}()
+	go func() {
+		defer wg.Done()
+		// exit-status and friends, until the upstream channel is closed
+		forwardRequests(ch, upReqs, &mu)
+	}()
+	wg.Wait()
+}
+
+func forwardRequests(to ssh.Channel, reqs <-chan *ssh.Request, mu *sync.Mutex) {
+	for req := range reqs {
+		mu.Lock()
+		ok, err := to.SendRequest(req.Type, req.WantReply, req.Payload)
+		if err != nil && !errors.Is(err, io.EOF) {
+			l.Error(err)
+		}
+		if req.WantReply {
+			req.Reply(ok, nil)
+		}
+		mu.Unlock()
+	}
+}
@@ -0,0 +1,157 @@
+package sshw
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestDaemon(t *testing.T) {
+	t.Setenv("SSHW_DAEMON_SOCKET", filepath.Join(t.TempDir(), "daemon.sock"))
+
+	node := newTestServer(t)
+	node.Multiplex = true
+
+	d, err := NewDaemon()
+	assert.Nil(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error)
+	go func() {
+		served <- d.ListenAndServe(ctx)
+	}()
+	defer func() {
+		cancel()
+		assert.Nil(t, <-served)
+	}()
+
+	for i := 0; i < 3; i++ {
+		client, err := dialDaemon(ctx, node)
+		if err != nil {
+			// the daemon may not listen yet
+			time.Sleep(time.Millisecond * 100)
+			client, err = dialDaemon(ctx, node)
+		}
+		assert.Nil(t, err)
+
+		s, err := client.NewSession()
+		assert.Nil(t, err)
+		out, err := s.Output("echo shared")
+		assert.Nil(t, err)
+		assert.Equal(t, "shared\n", string(out))
+
+		s, err = client.NewSession()
+		assert.Nil(t, err)
+		err = exitError(node.Host, s.Run("exit 3"))
+		assert.Equal(t, &ExitError{Host: node.Host, Status: 3}, err)
+
+		client.Close()
+	}
+
+	d.mu.Lock()
+	assert.Len(t, d.upstreams, 1)
+	d.mu.Unlock()
+
+	// only for the user, whatever the umask
+	info, err := os.Stat(os.Getenv("SSHW_DAEMON_SOCKET"))
+	assert.Nil(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	assert.NotNil(t, checkPeer(a))
+}
+
+func TestDaemonNotStarted(t *testing.T) {
+	t.Setenv("SSHW_DAEMON_SOCKET", filepath.Join(t.TempDir(), "daemon.sock"))
+
+	// a program using the package starts no daemon of its own
+	_, err := dialDaemon(context.Background(), &Node{Host: "127.0.0.1"})
+	assert.ErrorContains(t, err, "no DaemonCommand")
+}
+
+func TestDaemonUpstreamClosed(t *testing.T) {
+	t.Setenv("SSHW_DAEMON_SOCKET", filepath.Join(t.TempDir(), "daemon.sock"))
+
+	node := newTestServer(t)
+	node.Multiplex = true
+
+	d, err := NewDaemon()
+	assert.Nil(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error)
+	go func() {
+		served <- d.ListenAndServe(ctx)
+	}()
+	defer func() {
+		cancel()
+		assert.Nil(t, <-served)
+	}()
+
+	client, err := dialDaemon(ctx, node)
+	if err != nil {
+		time.Sleep(time.Millisecond * 100)
+		client, err = dialDaemon(ctx, node)
+	}
+	assert.Nil(t, err)
+	defer client.Close()
+
+	// channels are opened while the node goes away, e.g. after a keepalive failed
+	opened := make(chan struct{})
+	go func() {
+		defer close(opened)
+		for i := 0; i < 50; i++ {
+			if s, err := client.NewSession(); err == nil {
+				s.Close()
+			}
+		}
+	}()
+	time.Sleep(time.Millisecond * 10)
+	d.mu.Lock()
+	for _, u := range d.upstreams {
+		u.close()
+	}
+	d.mu.Unlock()
+	<-opened
+
+	// the daemon is still serving and connects again
+	var out []byte
+	for i := 0; i < 20; i++ {
+		c, err := dialDaemon(ctx, node)
+		if err == nil {
+			var s *ssh.Session
+			if s, err = c.NewSession(); err == nil {
+				out, err = s.Output("echo again")
+			}
+			c.Close()
+		}
+		if err == nil {
+			break
+		}
+		time.Sleep(time.Millisecond * 50)
+	}
+	assert.Equal(t, "again\n", string(out))
+}
+
+func TestNodeKey(t *testing.T) {
+	n := &Node{Host: "10.0.0.1", User: "root", Password: "a"}
+	same := &Node{Name: "other", Host: "10.0.0.1", User: "root", Password: "a"}
+	assert.Equal(t, n.key(), same.key())
+
+	// other credentials do not get the connection of these
+	for _, other := range []*Node{
+		{Host: "10.0.0.1", User: "root", Password: "b"},
+		{Host: "10.0.0.1", User: "root", Password: "a", KeyPath: "/tmp/key"},
+		{Host: "10.0.0.1", User: "root", Password: "a", Jump: []*Node{{Host: "bastion"}}},
+	} {
+		assert.NotEqual(t, n.key(), other.key())
+	}
+}
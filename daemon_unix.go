@@ -0,0 +1,10 @@
+//go:build unix
+
+package sshw
+
+import "syscall"
+
+// daemonSysProcAttr detaches the daemon from the terminal of sshw.
+func daemonSysProcAttr() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{Setsid: true}
+}
@@ -0,0 +1,85 @@
+package sshw
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+var (
+	// ErrAuthFailed is returned when the server rejected all auth methods.
+	ErrAuthFailed = errors.New("authentication failed")
+	// ErrHostUnreachable is returned when the node or its jump host can not be dialed.
+	ErrHostUnreachable = errors.New("host unreachable")
+	// ErrHostKeyMismatch is returned when the host key differs from known hosts.
+	ErrHostKeyMismatch = errors.New("host key mismatch")
+	// ErrChecksumMismatch is returned when a copied file differs from its source.
+	ErrChecksumMismatch = errors.New("checksum mismatch")
+)
+
+// ConnectError describes a failed connection to a node, use errors.Is with
+// ErrAuthFailed, ErrHostUnreachable or ErrHostKeyMismatch to tell the reason.
+type ConnectError struct {
+	Host string
+	Kind error
+	Err  error
+}
+
+func (e *ConnectError) Error() string {
+	if e.Kind == nil {
+		return fmt.Sprintf("connect %s fail : %s", e.Host, e.Err)
+	}
+	return fmt.Sprintf("connect %s fail, %s : %s", e.Host, e.Kind, e.Err)
+}
+
+func (e *ConnectError) Is(target error) bool {
+	return e.Kind != nil && target == e.Kind
+}
+
+func (e *ConnectError) Unwrap() error {
+	return e.Err
+}
+
+// ExitError is returned when the remote command or shell exits with a non zero status.
+type ExitError struct {
+	Host   string
+	Status int
+}
+
+func (e *ExitError) Error() string {
+	return fmt.Sprintf("%s exited with status %d", e.Host, e.Status)
+}
+
+// connectError classifies a failed dial or handshake of the node at host.
+func (c *defaultClient) connectError(host string, err error) error {
+	var kind error
+	var netErr net.Error
+
+	var keyErr *knownhosts.KeyError
+
+	switch {
+	case errors.As(c.hostKeyErr, &keyErr) && len(keyErr.Want) > 0:
+		kind, err = ErrHostKeyMismatch, c.hostKeyErr
+	case c.hostKeyErr != nil:
+		err = c.hostKeyErr
+	case errors.As(err, &netErr):
+		kind = ErrHostUnreachable
+	case c.hostKeyOK:
+		// the key exchange is done, only the authentication was left
+		kind = ErrAuthFailed
+	}
+
+	return &ConnectError{Host: host, Kind: kind, Err: err}
+}
+
+// exitError converts the error of session.Wait or session.Run.
+func exitError(host string, err error) error {
+	var exitErr *ssh.ExitError
+	if errors.As(err, &exitErr) {
+		return &ExitError{Host: host, Status: exitErr.ExitStatus()}
+	}
+	return err
+}
@@ -0,0 +1,136 @@
+package sshw
+
+import (
+	"math"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// HostNode is a node that can be connected to, with the path of the groups it is in.
+type HostNode struct {
+	*Node
+	Path string
+}
+
+// Hosts returns all nodes with a host that is not a pattern, in config order.
+func (c *Config) Hosts() []*HostNode {
+	var hosts []*HostNode
+	c.Walk(func(node *Node, parents []*Node) error {
+		if node.Host != "" && !node.IsPattern() {
+			hosts = append(hosts, &HostNode{Node: node, Path: nodePath(node, parents)})
+		}
+		return nil
+	})
+	return hosts
+}
+
+// Path returns the names of node and its groups joined by " / ".
+func (c *Config) Path(node *Node) string {
+	var p string
+	c.Walk(func(n *Node, parents []*Node) error {
+		if n == node {
+			p = nodePath(n, parents)
+			return errFound
+		}
+		return nil
+	})
+	return p
+}
+
+func nodePath(node *Node, parents []*Node) string {
+	names := make([]string, 0, len(parents)+1)
+	for _, p := range parents {
+		names = append(names, p.Name)
+	}
+	return strings.Join(append(names, node.Name), " / ")
+}
+
+func (h *HostNode) searchText() string {
+	text := h.Path + " " + h.Alias + " " + h.User + "@" + h.Node.Host
+	for _, tag := range h.AllTags() {
+		text += " #" + tag
+	}
+	return text
+}
+
+// RankHosts returns the hosts matching query, best first. Every space separated
+// word of the query has to fuzzy match the path, alias, address or tags of a
+// host. Hosts used often and recently rank higher.
+func RankHosts(hosts []*HostNode, query string, usage *Usage) []*HostNode {
+	type ranked struct {
+		host  *HostNode
+		score float64
+	}
+
+	words := strings.Fields(query)
+	var matches []ranked
+	for _, h := range hosts {
+		text := h.searchText()
+
+		total := 0
+		ok := true
+		for _, w := range words {
+			score, match := FuzzyScore(w, text)
+			if !match {
+				ok = false
+				break
+			}
+			total += score
+		}
+		if !ok {
+			continue
+		}
+
+		matches = append(matches, ranked{h, float64(total) + 5*math.Log2(1+usage.Frecency(h.Path))})
+	}
+
+	sort.SliceStable(matches, func(i, j int) bool {
+		return matches[i].score > matches[j].score
+	})
+
+	result := make([]*HostNode, len(matches))
+	for i := range matches {
+		result[i] = matches[i].host
+	}
+	return result
+}
+
+// FuzzyScore reports whether the runes of pattern appear in order in text,
+// ignoring case, and scores the match. Consecutive runes and runes at the
+// start of a word score higher, gaps between them lower the score.
+func FuzzyScore(pattern, text string) (int, bool) {
+	p := []rune(strings.ToLower(pattern))
+	t := []rune(strings.ToLower(text))
+
+	score := 0
+	first, prev := -1, -2
+	pi := 0
+	for ti := 0; ti < len(t) && pi < len(p); ti++ {
+		if t[ti] != p[pi] {
+			continue
+		}
+
+		s := 1
+		if ti == prev+1 {
+			s += 5
+		}
+		if ti == 0 || !unicode.IsLetter(t[ti-1]) && !unicode.IsDigit(t[ti-1]) {
+			s += 3
+		}
+		if first < 0 {
+			first = ti
+		}
+
+		score += s
+		prev = ti
+		pi++
+	}
+
+	if pi < len(p) {
+		return 0, false
+	}
+
+	gaps := prev - first + 1 - len(p)
+	return score - gaps/2, true
+}
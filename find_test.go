@@ -0,0 +1,51 @@
+package sshw
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFuzzyScore(t *testing.T) {
+	_, ok := FuzzyScore("gdb", "group / db")
+	assert.True(t, ok)
+	_, ok = FuzzyScore("dbg", "group / db")
+	assert.False(t, ok)
+
+	consecutive, _ := FuzzyScore("db", "group / db")
+	spread, _ := FuzzyScore("db", "dev / web")
+	assert.Greater(t, consecutive, spread)
+}
+
+func TestRankHosts(t *testing.T) {
+	c, err := ParseConfig([]byte(testConfig))
+	assert.Nil(t, err)
+
+	hosts := c.Hosts()
+	assert.Equal(t, "group / nested / web", hosts[2].Path)
+	assert.Equal(t, "group / db", c.Path(c.Lookup("db")))
+
+	paths := func(hosts []*HostNode) []string {
+		var p []string
+		for _, h := range hosts {
+			p = append(p, h.Path)
+		}
+		return p
+	}
+
+	assert.Equal(t, []string{"group / db", "group / nested / web"}, paths(RankHosts(hosts, "#prod", nil)))
+	assert.Equal(t, []string{"group / nested / web"}, paths(RankHosts(hosts, "nest w", nil)))
+
+	usage, err := LoadUsageFile(filepath.Join(t.TempDir(), "usage.jsonl"))
+	assert.Nil(t, err)
+	for i := 0; i < 3; i++ {
+		assert.Nil(t, usage.Add(UsageEntry{Time: time.Now(), Path: "group / nested / web"}))
+	}
+	assert.Equal(t, "group / nested / web", RankHosts(hosts, "", usage)[0].Path)
+
+	usage, err = LoadUsageFile(usage.path)
+	assert.Nil(t, err)
+	assert.Len(t, usage.Entries, 3)
+}
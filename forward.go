@@ -0,0 +1,145 @@
+package sshw
+
+import (
+	"context"
+	"io"
+	"net"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Forward is a port forwarding like ssh -L, or ssh -R when Remote is set.
+type Forward struct {
+	// Remote listens on the node and dials from here.
+	Remote bool
+	// Listen is the address connections are accepted on.
+	Listen string
+	// Dial is the address connections are forwarded to.
+	Dial string
+}
+
+func (f Forward) String() string {
+	if f.Remote {
+		return "remote " + f.Listen + " -> " + f.Dial
+	}
+	return f.Listen + " -> remote " + f.Dial
+}
+
+// ParseForward parses a forwarding spec [bind_address:]port:host:hostport as
+// ssh does, the bind address defaults to localhost.
+func ParseForward(spec string, remote bool) (Forward, error) {
+	var parts []string
+	for rest := spec; rest != ""; {
+		var part string
+		if strings.HasPrefix(rest, "[") {
+			// an ipv6 address
+			end := strings.Index(rest, "]")
+			if end < 0 {
+				return Forward{}, errors.Errorf("invalid forward : %s", spec)
+			}
+			part, rest = rest[1:end], strings.TrimPrefix(rest[end+1:], ":")
+		} else {
+			part, rest, _ = strings.Cut(rest, ":")
+		}
+		parts = append(parts, part)
+	}
+
+	switch len(parts) {
+	case 3:
+		parts = append([]string{"localhost"}, parts...)
+	case 4:
+		// all interfaces
+		if parts[0] == "*" {
+			parts[0] = ""
+		}
+	default:
+		return Forward{}, errors.Errorf("invalid forward : %s", spec)
+	}
+
+	return Forward{
+		Remote: remote,
+		Listen: net.JoinHostPort(parts[0], parts[1]),
+		Dial:   net.JoinHostPort(parts[2], parts[3]),
+	}, nil
+}
+
+// Forward returns nil once ctx is done, as that is the only way to end it.
+func (c *defaultClient) Forward(ctx context.Context, forwards ...Forward) error {
+	if c.client == nil {
+		err := c.connect(ctx)
+		if err != nil {
+			return err
+		}
+		defer c.Close()
+	}
+
+	errc := make(chan error, len(forwards)+1)
+	for _, f := range forwards {
+		var ln net.Listener
+		var err error
+		if f.Remote {
+			ln, err = c.client.Listen("tcp", f.Listen)
+		} else {
+			ln, err = net.Listen("tcp", f.Listen)
+		}
+		if err != nil {
+			return errors.Wrapf(err, "listen %s fail", f.Listen)
+		}
+		defer ln.Close()
+
+		go func(f Forward, ln net.Listener) {
+			errc <- c.serveForward(f, ln)
+		}(f, ln)
+	}
+
+	client := c.client
+	go func() {
+		errc <- &ConnectError{Host: c.node.Host, Kind: ErrHostUnreachable, Err: client.Wait()}
+	}()
+
+	select {
+	case <-ctx.Done():
+		return nil
+	case err := <-errc:
+		return err
+	}
+}
+
+func (c *defaultClient) serveForward(f Forward, ln net.Listener) error {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return errors.Wrapf(err, "forward %s fail", f)
+		}
+
+		go func() {
+			defer conn.Close()
+
+			var target net.Conn
+			var err error
+			if f.Remote {
+				target, err = net.Dial("tcp", f.Dial)
+			} else {
+				target, err = c.client.Dial("tcp", f.Dial)
+			}
+			if err != nil {
+				l.Errorf("forward %s fail : %s", f, err)
+				return
+			}
+			defer target.Close()
+
+			// both sides are closed as soon as one of them is done
+			done := make(chan struct{}, 2)
+			go func() {
+				io.Copy(target, conn)
+				done <- struct{}{}
+			}()
+			go func() {
+				io.Copy(conn, target)
+				done <- struct{}{}
+			}()
+			<-done
+		}()
+	}
+}
@@ -0,0 +1,75 @@
+package sshw
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseForward(t *testing.T) {
+	f, err := ParseForward("8080:db:5432", false)
+	assert.Nil(t, err)
+	assert.Equal(t, Forward{Listen: "localhost:8080", Dial: "db:5432"}, f)
+
+	f, err = ParseForward("*:8080:[::1]:80", true)
+	assert.Nil(t, err)
+	assert.Equal(t, Forward{Remote: true, Listen: ":8080", Dial: "[::1]:80"}, f)
+
+	_, err = ParseForward("8080:db", false)
+	assert.NotNil(t, err)
+}
+
+func TestForward(t *testing.T) {
+	// an echo server only reachable through the node
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer echo.Close()
+	go func() {
+		for {
+			conn, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				line, _ := bufio.NewReader(conn).ReadString('\n')
+				conn.Write([]byte(line))
+			}()
+		}
+	}()
+
+	// reserve a free port to listen on
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	addr := ln.Addr().String()
+	ln.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- NewClient(newTestServer(t)).Forward(ctx, Forward{Listen: addr, Dial: echo.Addr().String()})
+	}()
+
+	var conn net.Conn
+	for i := 0; i < 50; i++ {
+		conn, err = net.Dial("tcp", addr)
+		if err == nil {
+			break
+		}
+		time.Sleep(time.Millisecond * 20)
+	}
+	assert.Nil(t, err)
+
+	conn.Write([]byte("hello\n"))
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	assert.Nil(t, err)
+	assert.Equal(t, "hello\n", line)
+	conn.Close()
+
+	cancel()
+	assert.Nil(t, <-done)
+}
@@ -1,75 +1,116 @@
 package sshw
 
 import (
+	"bufio"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
+	"regexp"
+	"strings"
 	"time"
-)
-
-var dfhistfile = make(map[string]string)
 
-func init() {
-	hdir, err := os.UserHomeDir()
-	if err != nil {
-		l.Errorf("get home dir fail : %s", err)
-		return
-	}
+	"github.com/pkg/errors"
+)
 
-	dfhistfile = map[string]string{
-		"zsh":  hdir + "/.zsh_history",
-		"bash": hdir + "/.bash_history",
-		"sh":   hdir + "/.bash_history",
-	}
-}
+// ErrUnknownShell is returned by RecordHistory when the history of $SHELL is not supported.
+var ErrUnknownShell = errors.New("unknown shell")
 
-var histformatter = map[string]func(string) string{
-	"zsh": func(s string) string {
-		return fmt.Sprintf(": %d:0;%s\n", time.Now().Unix(), s)
-	},
-	"bash": func(s string) string {
-		return s + "\n"
-	},
-	"sh": func(s string) string {
-		return s + "\n"
-	},
-}
+var zshExtendedEntry = regexp.MustCompile(`^: \d+:\d+;`)
 
+// RecordHistory appends the sshw command cmd to the history file of $SHELL,
+// so that it can be repeated from the shell. bash, sh, zsh and fish are supported.
 func RecordHistory(cmd string) error {
-	var err error
-
-	bin := filepath.Base(os.Args[0])
-	cmd = bin + " " + cmd
-
 	sh := filepath.Base(os.Getenv("SHELL"))
 
-	histfile, ok := dfhistfile[sh]
-	if !ok {
+	histfile, err := historyFile(sh)
+	if err != nil {
 		return err
 	}
 
-	formatter, ok := histformatter[sh]
-	if !ok {
-		return err
-	}
+	bin := filepath.Base(os.Args[0])
+	return recordHistory(sh, histfile, bin+" "+cmd, time.Now())
+}
 
-	histfile, err = filepath.Abs(histfile)
+// historyFile returns the history file of shell, $HISTFILE if set.
+func historyFile(shell string) (string, error) {
+	home, err := os.UserHomeDir()
 	if err != nil {
-		l.Errorf("abs file fail :%s", err)
-		return err
+		return "", errors.Wrap(err, "get home dir fail")
 	}
 
-	f, err := os.OpenFile(histfile, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	switch shell {
+	case "bash", "sh", "zsh":
+		if f := os.Getenv("HISTFILE"); f != "" {
+			return f, nil
+		}
+		if shell == "zsh" {
+			dir := os.Getenv("ZDOTDIR")
+			if dir == "" {
+				dir = home
+			}
+			return filepath.Join(dir, ".zsh_history"), nil
+		}
+		return filepath.Join(home, ".bash_history"), nil
+	case "fish":
+		dir := os.Getenv("XDG_DATA_HOME")
+		if dir == "" {
+			dir = filepath.Join(home, ".local", "share")
+		}
+		name := os.Getenv("fish_history")
+		if name == "" {
+			name = "fish"
+		}
+		return filepath.Join(dir, "fish", name+"_history"), nil
+	}
+	return "", errors.Wrap(ErrUnknownShell, shell)
+}
+
+func recordHistory(shell, histfile, cmd string, now time.Time) error {
+	f, err := os.OpenFile(histfile, os.O_CREATE|os.O_APPEND|os.O_RDWR, 0600)
 	if err != nil {
-		l.Errorf("open file fail : %s", err)
-		return err
+		return errors.Wrap(err, "open history fail")
 	}
+	defer f.Close()
 
-	_, err = f.WriteString(formatter(cmd))
+	// the shells may write their history at the same time, the lock is
+	// released when the file is closed
+	err = lockFile(f)
 	if err != nil {
-		l.Errorf("write cmd fail : %s", err)
-		return err
+		return errors.Wrap(err, "lock history fail")
 	}
 
+	var entry string
+	switch shell {
+	case "zsh":
+		if zshExtended(f) {
+			entry = fmt.Sprintf(": %d:0;%s\n", now.Unix(), cmd)
+		} else {
+			entry = cmd + "\n"
+		}
+	case "fish":
+		cmd = strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(cmd)
+		entry = fmt.Sprintf("- cmd: %s\n  when: %d\n", cmd, now.Unix())
+	default:
+		entry = cmd + "\n"
+	}
+
+	_, err = f.WriteString(entry)
+	if err != nil {
+		return errors.Wrap(err, "write history fail")
+	}
 	return nil
 }
+
+// zshExtended reports whether the history is written with EXTENDED_HISTORY,
+// judged by its first entry. zsh reads both formats, so an empty history gets
+// the extended one.
+func zshExtended(r io.Reader) bool {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		if line := scanner.Text(); line != "" {
+			return zshExtendedEntry.MatchString(line)
+		}
+	}
+	return true
+}
@@ -0,0 +1,43 @@
+package sshw
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRecordHistory(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Unix(1700000000, 0)
+
+	read := func(name string) string {
+		b, err := os.ReadFile(filepath.Join(dir, name))
+		assert.Nil(t, err)
+		return string(b)
+	}
+
+	assert.Nil(t, recordHistory("bash", filepath.Join(dir, "bash"), "sshw dev", now))
+	assert.Equal(t, "sshw dev\n", read("bash"))
+
+	assert.Nil(t, recordHistory("zsh", filepath.Join(dir, "zsh"), "sshw dev", now))
+	assert.Nil(t, recordHistory("zsh", filepath.Join(dir, "zsh"), "sshw db", now))
+	assert.Equal(t, ": 1700000000:0;sshw dev\n: 1700000000:0;sshw db\n", read("zsh"))
+
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "zsh-plain"), []byte("ls\n"), 0600))
+	assert.Nil(t, recordHistory("zsh", filepath.Join(dir, "zsh-plain"), "sshw dev", now))
+	assert.Equal(t, "ls\nsshw dev\n", read("zsh-plain"))
+
+	assert.Nil(t, recordHistory("fish", filepath.Join(dir, "fish"), `sshw scp dev:C:\tmp ./`, now))
+	assert.Equal(t, "- cmd: sshw scp dev:C:\\\\tmp ./\n  when: 1700000000\n", read("fish"))
+
+	t.Setenv("HISTFILE", filepath.Join(dir, "custom"))
+	f, err := historyFile("bash")
+	assert.Nil(t, err)
+	assert.Equal(t, filepath.Join(dir, "custom"), f)
+
+	_, err = historyFile("nu")
+	assert.ErrorIs(t, err, ErrUnknownShell)
+}
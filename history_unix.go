@@ -0,0 +1,16 @@
+//go:build unix
+
+package sshw
+
+import (
+	"io"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// lockFile waits for an exclusive fcntl lock on f, the kind zsh takes with HIST_FCNTL_LOCK.
+func lockFile(f *os.File) error {
+	lk := unix.Flock_t{Type: unix.F_WRLCK, Whence: io.SeekStart}
+	return unix.FcntlFlock(f.Fd(), unix.F_SETLKW, &lk)
+}
@@ -0,0 +1,10 @@
+//go:build windows
+
+package sshw
+
+import "os"
+
+// lockFile does nothing, the shells sshw writes history for do not lock on windows.
+func lockFile(f *os.File) error {
+	return nil
+}
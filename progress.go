@@ -0,0 +1,227 @@
+package sshw
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+const (
+	progressInterval = time.Millisecond * 150
+	progressWidth    = 25
+)
+
+// progress shows a line per transfer and the total of all of them below,
+// redrawn in place. Finished transfers are printed once above the running
+// ones. Without a terminal, only the finished ones are printed.
+type progress struct {
+	w        io.Writer
+	terminal bool
+	start    time.Time
+
+	mu    sync.Mutex
+	bars  []*bar
+	lines int
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// bar is a transfer of progress, it counts what is written to it.
+type bar struct {
+	p     *progress
+	desc  string
+	size  int64
+	start time.Time
+
+	// guarded by the mutex of the progress
+	n        int64
+	end      time.Time
+	err      error
+	finished bool
+	printed  bool
+}
+
+func newProgress(w *os.File) *progress {
+	p := &progress{
+		w:        w,
+		terminal: terminal.IsTerminal(int(w.Fd())),
+		start:    time.Now(),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+
+	go func() {
+		defer close(p.done)
+		ticker := time.NewTicker(progressInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				p.render(false)
+			case <-p.stop:
+				p.render(true)
+				return
+			}
+		}
+	}()
+	return p
+}
+
+// add adds a transfer of size bytes.
+func (p *progress) add(desc string, size int64) *bar {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	b := &bar{p: p, desc: desc, size: size, start: time.Now()}
+	p.bars = append(p.bars, b)
+	return b
+}
+
+// close draws the final state and stops redrawing.
+func (p *progress) close() {
+	select {
+	case <-p.stop:
+	default:
+		close(p.stop)
+	}
+	<-p.done
+}
+
+func (p *progress) render(final bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var sb strings.Builder
+	clear := ""
+	if p.terminal {
+		clear = "\r\x1b[K"
+		if p.lines > 0 {
+			// back to the first running transfer
+			fmt.Fprintf(&sb, "\x1b[%dA", p.lines)
+		}
+	}
+
+	// the finished ones stay above, the running ones are drawn again each time
+	var running []*bar
+	for _, b := range p.bars {
+		switch {
+		case b.finished && !b.printed:
+			sb.WriteString(clear + p.line(b) + "\n")
+			b.printed = true
+		case !b.finished:
+			running = append(running, b)
+		}
+	}
+
+	p.lines = 0
+	if p.terminal {
+		for _, b := range running {
+			sb.WriteString(clear + p.line(b) + "\n")
+		}
+		p.lines = len(running)
+	}
+	if len(p.bars) > 1 && (p.terminal || final) {
+		sb.WriteString(clear + p.total() + "\n")
+		p.lines++
+	}
+	if p.terminal {
+		// lines of transfers that finished since
+		sb.WriteString("\x1b[J")
+	}
+
+	io.WriteString(p.w, sb.String())
+}
+
+func (p *progress) line(b *bar) string {
+	end := time.Now()
+	if b.finished {
+		end = b.end
+	}
+
+	status := fmt.Sprintf("%s/%s, %s/s", humanBytes(b.n), humanBytes(b.size), humanBytes(rate(b.n, end.Sub(b.start))))
+	if b.err != nil {
+		status = "failed"
+	}
+	return fmt.Sprintf("%s %s %3d%% (%s)", b.desc, p.gauge(b.n, b.size), percent(b.n, b.size), status)
+}
+
+func (p *progress) total() string {
+	var n, size int64
+	var finished int
+	for _, b := range p.bars {
+		n += b.n
+		size += b.size
+		if b.finished {
+			finished++
+		}
+	}
+	return fmt.Sprintf("total %d/%d files %s %3d%% (%s/%s, %s/s)", finished, len(p.bars),
+		p.gauge(n, size), percent(n, size), humanBytes(n), humanBytes(size), humanBytes(rate(n, time.Since(p.start))))
+}
+
+func (p *progress) gauge(n, size int64) string {
+	filled := progressWidth
+	if size > 0 && n < size {
+		filled = int(n * progressWidth / size)
+	}
+
+	saucer := strings.Repeat("=", filled)
+	if filled < progressWidth {
+		saucer += ">" + strings.Repeat(" ", progressWidth-filled-1)
+	}
+	if p.terminal {
+		return "[\x1b[32m" + saucer + "\x1b[0m]"
+	}
+	return "[" + saucer + "]"
+}
+
+func (b *bar) Write(data []byte) (int, error) {
+	b.p.mu.Lock()
+	b.n += int64(len(data))
+	b.p.mu.Unlock()
+	return len(data), nil
+}
+
+// finish marks the transfer as done, failed when err is not nil.
+func (b *bar) finish(err error) {
+	b.p.mu.Lock()
+	defer b.p.mu.Unlock()
+
+	if !b.finished {
+		b.finished, b.err, b.end = true, err, time.Now()
+	}
+}
+
+func percent(n, size int64) int {
+	if size <= 0 || n >= size {
+		return 100
+	}
+	return int(n * 100 / size)
+}
+
+func rate(n int64, d time.Duration) int64 {
+	if d <= 0 {
+		return 0
+	}
+	return int64(float64(n) / d.Seconds())
+}
+
+// humanBytes formats n in powers of 1024, like the rates of ParseRate.
+func humanBytes(n int64) string {
+	if n < 1024 {
+		return fmt.Sprintf("%d B", n)
+	}
+	units := []string{"kB", "MB", "GB", "TB", "PB", "EB"}
+	e := int(math.Log(float64(n)) / math.Log(1024))
+	if e > len(units) {
+		e = len(units)
+	}
+	return fmt.Sprintf("%.1f %s", float64(n)/math.Pow(1024, float64(e)), units[e-1])
+}
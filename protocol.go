@@ -3,9 +3,12 @@ package sshw
 import (
 	"bufio"
 	"errors"
+	"fmt"
 	"io"
+	"os"
 	"strconv"
 	"strings"
+	"time"
 )
 
 type ResponseType = uint8
@@ -14,6 +17,8 @@ const (
 	Ok      ResponseType = 0
 	Warning ResponseType = 1
 	Error   ResponseType = 2
+	// Times is the record of the modification and access times sent before a file with -p.
+	Times ResponseType = 'T'
 )
 
 // Response represent a response from the SCP command.
@@ -104,6 +109,49 @@ func (r *Response) ParseFileInfos() (*FileInfos, error) {
 	}, nil
 }
 
+// Mode returns the permission bits of the file.
+func (f *FileInfos) Mode() (os.FileMode, error) {
+	mode, err := strconv.ParseUint(f.Permissions, 8, 32)
+	if err != nil {
+		return 0, err
+	}
+	return os.FileMode(mode).Perm(), nil
+}
+
+type FileTimes struct {
+	Mtime time.Time
+	Atime time.Time
+}
+
+// IsTimes returns true when the remote sent the times of the next file.
+func (r *Response) IsTimes() bool {
+	return r.Type == Times
+}
+
+// ParseFileTimes parses a `T<mtime> 0 <atime> 0` record.
+func (r *Response) ParseFileTimes() (*FileTimes, error) {
+	parts := strings.Fields(r.Message)
+	if len(parts) != 4 {
+		return nil, errors.New("unable to parse message as file times")
+	}
+
+	mtime, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	atime, err := strconv.ParseInt(parts[2], 10, 64)
+	if err != nil {
+		return nil, err
+	}
+
+	return &FileTimes{Mtime: time.Unix(mtime, 0), Atime: time.Unix(atime, 0)}, nil
+}
+
+// TimesMessage is the record that sends the times of a file before it.
+func TimesMessage(t *FileTimes) string {
+	return fmt.Sprintf("T%d 0 %d 0\n", t.Mtime.Unix(), t.Atime.Unix())
+}
+
 // Ack writes an `Ack` message to the remote, does not await its response, a seperate call to ParseResponse is
 // therefore required to check if the acknowledgement succeeded.
 func Ack(writer io.Writer) error {
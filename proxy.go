@@ -0,0 +1,323 @@
+package sshw
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// noProxy connects directly even when the config has a global proxy.
+const noProxy = "direct"
+
+// dialTCP connects to addr, through proxy when it is a socks5:// or http:// url.
+// Errors of the proxy are net errors too, as the host is unreachable.
+func dialTCP(ctx context.Context, proxy, addr string, timeout time.Duration) (net.Conn, error) {
+	d := net.Dialer{Timeout: timeout}
+	if proxy == "" || proxy == noProxy {
+		return d.DialContext(ctx, "tcp", addr)
+	}
+
+	u, err := url.Parse(proxy)
+	if err != nil {
+		return nil, errors.Wrap(err, "parse proxy fail")
+	}
+	var handshake func(conn net.Conn, u *url.URL, addr string) (net.Conn, error)
+	switch u.Scheme {
+	case "socks5", "socks5h":
+		handshake = socks5Connect
+	case "http":
+		handshake = httpConnect
+	default:
+		return nil, errors.Errorf("unsupported proxy : %s", proxy)
+	}
+
+	proxyAddr := u.Host
+	if u.Port() == "" {
+		port := "1080"
+		if u.Scheme == "http" {
+			port = "80"
+		}
+		proxyAddr = net.JoinHostPort(u.Hostname(), port)
+	}
+
+	conn, err := d.DialContext(ctx, "tcp", proxyAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	// the handshake has the same time to finish as the connect
+	if timeout > 0 {
+		conn.SetDeadline(time.Now().Add(timeout))
+	}
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-stop:
+		}
+	}()
+
+	pconn, err := handshake(conn, u, addr)
+	if err != nil {
+		conn.Close()
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, &net.OpError{Op: "proxy", Net: "tcp", Addr: conn.RemoteAddr(), Err: err}
+	}
+	conn.SetDeadline(time.Time{})
+	return pconn, nil
+}
+
+// socks5Connect asks a socks5 server to connect to addr, see rfc 1928 and 1929.
+// The host name is resolved by the server.
+func socks5Connect(conn net.Conn, u *url.URL, addr string) (net.Conn, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return nil, err
+	}
+
+	const (
+		version      = 5
+		authNone     = 0
+		authPassword = 2
+		cmdConnect   = 1
+		atypIPv4     = 1
+		atypDomain   = 3
+		atypIPv6     = 4
+	)
+
+	methods := []byte{authNone}
+	if u.User != nil {
+		methods = append(methods, authPassword)
+	}
+	_, err = conn.Write(append([]byte{version, byte(len(methods))}, methods...))
+	if err != nil {
+		return nil, err
+	}
+
+	b := make([]byte, 2)
+	_, err = io.ReadFull(conn, b)
+	if err != nil {
+		return nil, err
+	}
+	if b[0] != version {
+		return nil, errors.Errorf("socks5 proxy: unexpected version %d", b[0])
+	}
+
+	switch b[1] {
+	case authNone:
+	case authPassword:
+		pass, _ := u.User.Password()
+		name := u.User.Username()
+		req := append([]byte{1, byte(len(name))}, name...)
+		req = append(append(req, byte(len(pass))), pass...)
+		_, err = conn.Write(req)
+		if err != nil {
+			return nil, err
+		}
+		_, err = io.ReadFull(conn, b)
+		if err != nil {
+			return nil, err
+		}
+		if b[1] != 0 {
+			return nil, errors.New("socks5 proxy: authentication failed")
+		}
+	default:
+		return nil, errors.New("socks5 proxy: no acceptable authentication method")
+	}
+
+	req := []byte{version, cmdConnect, 0}
+	if ip := net.ParseIP(host); ip.To4() != nil {
+		req = append(append(req, atypIPv4), ip.To4()...)
+	} else if ip != nil {
+		req = append(append(req, atypIPv6), ip.To16()...)
+	} else {
+		req = append(append(req, atypDomain, byte(len(host))), host...)
+	}
+	req = binary.BigEndian.AppendUint16(req, uint16(port))
+	_, err = conn.Write(req)
+	if err != nil {
+		return nil, err
+	}
+
+	// version, reply, reserved, address type, then the bound address and port
+	b = make([]byte, 4)
+	_, err = io.ReadFull(conn, b)
+	if err != nil {
+		return nil, err
+	}
+	if b[1] != 0 {
+		return nil, errors.Errorf("socks5 proxy: connect %s failed with reply %d", addr, b[1])
+	}
+
+	var skip int
+	switch b[3] {
+	case atypIPv4:
+		skip = net.IPv4len
+	case atypIPv6:
+		skip = net.IPv6len
+	case atypDomain:
+		_, err = io.ReadFull(conn, b[:1])
+		if err != nil {
+			return nil, err
+		}
+		skip = int(b[0])
+	default:
+		return nil, errors.Errorf("socks5 proxy: unexpected address type %d", b[3])
+	}
+	_, err = io.CopyN(io.Discard, conn, int64(skip+2))
+	if err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+// httpConnect asks an http proxy to connect to addr with the CONNECT method.
+func httpConnect(conn net.Conn, u *url.URL, addr string) (net.Conn, error) {
+	req := "CONNECT " + addr + " HTTP/1.1\r\nHost: " + addr + "\r\n"
+	if u.User != nil {
+		pass, _ := u.User.Password()
+		req += "Proxy-Authorization: Basic " + base64.StdEncoding.EncodeToString([]byte(u.User.Username()+":"+pass)) + "\r\n"
+	}
+	_, err := io.WriteString(conn, req+"\r\n")
+	if err != nil {
+		return nil, err
+	}
+
+	r := bufio.NewReader(conn)
+	res, err := http.ReadResponse(r, &http.Request{Method: http.MethodConnect})
+	if err != nil {
+		return nil, err
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("http proxy: connect %s failed : %s", addr, res.Status)
+	}
+
+	// the server may send its version right away, it is buffered in r already
+	return &bufferedConn{Conn: conn, r: r}, nil
+}
+
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// proxyCommand is the proxy command of the node with %h, %p and %r replaced.
+// Hosts and users may come from the command line, like openssh the ones the
+// shell would interpret are refused.
+func (n *Node) proxyCommand() (string, error) {
+	for _, s := range []string{n.Host, n.user()} {
+		if !isProxyCommandArg(s) {
+			return "", errors.Errorf("proxy command: invalid characters in %q", s)
+		}
+	}
+	r := strings.NewReplacer("%%", "%", "%h", n.Host, "%p", strconv.Itoa(n.port()), "%r", n.user())
+	return r.Replace(n.ProxyCommand), nil
+}
+
+func isProxyCommandArg(s string) bool {
+	if s == "" || s[0] == '-' {
+		return false
+	}
+	for _, r := range s {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+		case strings.ContainsRune(".-_:@[]", r):
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// dialCommand starts command and returns a connection over its stdin and stdout,
+// like the ProxyCommand of ssh. Closing the connection kills the command.
+func dialCommand(command string) (net.Conn, error) {
+	cmd := shellCommand(command)
+	cmd.Stderr = os.Stderr
+	w, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	r, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	err = cmd.Start()
+	if err != nil {
+		return nil, &net.OpError{Op: "proxy", Net: "pipe", Addr: commandAddr(command), Err: err}
+	}
+	return &commandConn{cmd: cmd, r: r, w: w}, nil
+}
+
+type commandConn struct {
+	cmd  *exec.Cmd
+	r    io.ReadCloser
+	w    io.WriteCloser
+	once sync.Once
+}
+
+func (c *commandConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *commandConn) Write(b []byte) (int, error) {
+	return c.w.Write(b)
+}
+
+func (c *commandConn) Close() error {
+	c.once.Do(func() {
+		c.w.Close()
+		c.cmd.Process.Kill()
+		c.cmd.Wait()
+	})
+	return nil
+}
+
+func (c *commandConn) LocalAddr() net.Addr {
+	return commandAddr("")
+}
+
+func (c *commandConn) RemoteAddr() net.Addr {
+	return commandAddr(c.cmd.String())
+}
+
+// the ssh package does not use deadlines, the handshake is canceled by closing
+func (c *commandConn) SetDeadline(t time.Time) error      { return nil }
+func (c *commandConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *commandConn) SetWriteDeadline(t time.Time) error { return nil }
+
+type commandAddr string
+
+func (a commandAddr) Network() string {
+	return "pipe"
+}
+
+func (a commandAddr) String() string {
+	return string(a)
+}
@@ -0,0 +1,236 @@
+package sshw
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newSocks5Server starts a socks5 server that requires user and pass when
+// user is set. It returns its address and counts the connects it made.
+func newSocks5Server(t *testing.T, user, pass string, connects *int32) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go serveSocks5(conn, user, pass, connects)
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func serveSocks5(conn net.Conn, user, pass string, connects *int32) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+
+	b := make([]byte, 2)
+	io.ReadFull(r, b)
+	io.ReadFull(r, make([]byte, b[1]))
+
+	if user == "" {
+		conn.Write([]byte{5, 0})
+	} else {
+		conn.Write([]byte{5, 2})
+		io.ReadFull(r, b)
+		u := make([]byte, b[1])
+		io.ReadFull(r, u)
+		io.ReadFull(r, b[:1])
+		p := make([]byte, b[0])
+		io.ReadFull(r, p)
+		if string(u) != user || string(p) != pass {
+			conn.Write([]byte{1, 1})
+			return
+		}
+		conn.Write([]byte{1, 0})
+	}
+
+	req := make([]byte, 4)
+	io.ReadFull(r, req)
+	var host string
+	switch req[3] {
+	case 1:
+		ip := make([]byte, 4)
+		io.ReadFull(r, ip)
+		host = net.IP(ip).String()
+	case 3:
+		io.ReadFull(r, b[:1])
+		name := make([]byte, b[0])
+		io.ReadFull(r, name)
+		host = string(name)
+	}
+	io.ReadFull(r, b)
+	port := binary.BigEndian.Uint16(b)
+
+	target, err := net.Dial("tcp", net.JoinHostPort(host, strconv.Itoa(int(port))))
+	if err != nil {
+		conn.Write([]byte{5, 5, 0, 1, 0, 0, 0, 0, 0, 0})
+		return
+	}
+	defer target.Close()
+	atomic.AddInt32(connects, 1)
+	conn.Write([]byte{5, 0, 0, 1, 127, 0, 0, 1, 0, 0})
+
+	go io.Copy(target, r)
+	io.Copy(conn, target)
+}
+
+func TestSocks5Proxy(t *testing.T) {
+	var connects int32
+	node := newTestServer(t)
+	node.Proxy = "socks5://sshw:secret@" + newSocks5Server(t, "sshw", "secret", &connects)
+
+	c := NewClient(node)
+	assert.Nil(t, c.Connect(context.Background()))
+	c.Close()
+	assert.Equal(t, int32(1), connects)
+
+	// the proxy is used for the jump host, the rest goes through it
+	target := newTestServer(t)
+	jump := *node
+	jump.Proxy = ""
+	target.Jump = []*Node{&jump}
+	target.Proxy = node.Proxy
+	c = NewClient(target)
+	assert.Nil(t, c.Connect(context.Background()))
+	c.Close()
+	assert.Equal(t, int32(2), connects)
+
+	node.Proxy = "socks5://sshw:wrong@" + newSocks5Server(t, "sshw", "secret", &connects)
+	err := NewClient(node).Connect(context.Background())
+	assert.ErrorIs(t, err, ErrHostUnreachable)
+}
+
+func TestHTTPProxy(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer ln.Close()
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				req, err := http.ReadRequest(r)
+				if err != nil || req.Method != http.MethodConnect {
+					return
+				}
+				target, err := net.Dial("tcp", req.Host)
+				if err != nil {
+					io.WriteString(conn, "HTTP/1.1 502 Bad Gateway\r\n\r\n")
+					return
+				}
+				defer target.Close()
+				io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+				go io.Copy(target, r)
+				io.Copy(conn, target)
+			}()
+		}
+	}()
+
+	node := newTestServer(t)
+	node.Proxy = "http://" + ln.Addr().String()
+	c := NewClient(node)
+	assert.Nil(t, c.Connect(context.Background()))
+	c.Close()
+}
+
+func TestConfigProxy(t *testing.T) {
+	c, err := ParseConfig([]byte(`
+proxy: socks5://127.0.0.1:1080
+nodes:
+- { name: dev, host: 192.168.8.35 }
+- { name: office, host: 10.0.0.2, proxy: direct }
+`))
+	assert.Nil(t, err)
+	assert.Equal(t, "socks5://127.0.0.1:1080", c.Lookup("dev").Proxy)
+	assert.Equal(t, "direct", c.Lookup("office").Proxy)
+	assert.Equal(t, "socks5://127.0.0.1:1080", c.Target("example.com").Proxy)
+}
+
+// TestProxyCommandHelper is the proxy command of TestProxyCommand, it connects
+// its stdin and stdout to the host and port after "--".
+func TestProxyCommandHelper(t *testing.T) {
+	if os.Getenv("SSHW_PROXY_COMMAND_HELPER") == "" {
+		return
+	}
+	args := os.Args
+	for len(args) > 0 && args[0] != "--" {
+		args = args[1:]
+	}
+	conn, err := net.Dial("tcp", net.JoinHostPort(args[1], args[2]))
+	if err != nil {
+		os.Exit(1)
+	}
+	go io.Copy(conn, os.Stdin)
+	io.Copy(os.Stdout, conn)
+	os.Exit(0)
+}
+
+func TestProxyCommand(t *testing.T) {
+	n := &Node{Host: "10.0.0.2", Port: 2222, User: "deploy", ProxyCommand: "connect %h:%p as %r, not %%h"}
+	command, err := n.proxyCommand()
+	assert.Nil(t, err)
+	assert.Equal(t, "connect 10.0.0.2:2222 as deploy, not %h", command)
+
+	// targets of the command line are not run by the shell
+	for _, bad := range []*Node{
+		{Host: "a;touch /tmp/x", ProxyCommand: "nc %h %p"},
+		{Host: "10.0.0.2", User: "$(id)", ProxyCommand: "nc %h %p"},
+		{Host: "-oProxyCommand=x", ProxyCommand: "nc %h %p"},
+	} {
+		_, err = bad.proxyCommand()
+		assert.NotNil(t, err, bad.Host)
+	}
+	_, err = (&Node{Host: "fe80::1", User: "deploy_1", ProxyCommand: "nc %h %p"}).proxyCommand()
+	assert.Nil(t, err)
+
+	helper := "SSHW_PROXY_COMMAND_HELPER=1 " + strconv.Quote(os.Args[0]) + " -test.run=^TestProxyCommandHelper$ -- %h %p"
+
+	node := newTestServer(t)
+	node.ProxyCommand = helper
+	c := NewClient(node)
+	assert.Nil(t, c.Connect(context.Background()))
+	assert.Nil(t, c.Exec(context.Background(), "true"))
+	c.Close()
+
+	// the command of the node is for the jump host
+	target := newTestServer(t)
+	jump := *node
+	jump.ProxyCommand = ""
+	target.Jump = []*Node{&jump}
+	target.ProxyCommand = helper
+	c = NewClient(target)
+	assert.Nil(t, c.Connect(context.Background()))
+	c.Close()
+
+	node.ProxyCommand = "exit 1"
+	assert.NotNil(t, NewClient(node).Connect(context.Background()))
+
+	// a command that never answers gives up after the timeout
+	node.ProxyCommand = "exec sleep 10"
+	dc := genSSHConfig(node)
+	dc.clientConfig.Timeout = time.Millisecond * 200
+	start := time.Now()
+	assert.NotNil(t, dc.connect(context.Background()))
+	assert.Less(t, time.Since(start), time.Second*5)
+}
@@ -0,0 +1,196 @@
+package sshw
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	minReconnectDelay = time.Second
+	maxReconnectDelay = time.Second * 30
+
+	connectionCheckTimeout = time.Second * 5
+)
+
+// isConnectionLost reports whether a session ended because the transport went
+// away, rather than the remote shell exiting.
+func isConnectionLost(err error) bool {
+	var (
+		missingErr *ssh.ExitMissingError
+		netErr     net.Error
+	)
+	return errors.As(err, &missingErr) || errors.As(err, &netErr) || errors.Is(err, io.EOF) || errors.Is(err, ErrHostUnreachable)
+}
+
+// connectionDead reports whether the connection no longer answers a
+// keepalive. A session also ends without an exit status or with EOF on a live
+// connection, e.g. when the shell is killed by a signal, which is no reason
+// to reconnect.
+func (c *defaultClient) connectionDead() bool {
+	client := c.client
+	if client == nil {
+		return true
+	}
+
+	replied := make(chan error, 1)
+	go func() {
+		// any reply will do, servers may refuse requests they do not know
+		_, _, err := client.SendRequest("keepalive@openssh.com", true, nil)
+		replied <- err
+	}()
+
+	select {
+	case err := <-replied:
+		return err != nil
+	case <-time.After(connectionCheckTimeout):
+		return true
+	}
+}
+
+// reconnect dials the node again with exponential backoff, reusing the
+// credentials cached by the first login. Pressing Ctrl-C while waiting aborts.
+func (c *defaultClient) reconnect(ctx context.Context, stdin *stdinRelay) error {
+	c.setReconnecting(true)
+	defer c.setReconnecting(false)
+
+	maxRetries := c.node.Reconnect.MaxRetries
+	delay := minReconnectDelay
+
+	for i := 1; maxRetries <= 0 || i <= maxRetries; i++ {
+		fmt.Fprintf(os.Stderr, "\r\nconnection to %s lost, reconnecting in %s (%d) ...\r\n", c.node.Host, delay, i)
+
+		select {
+		case <-time.After(delay):
+		case <-stdin.interrupted():
+			return errors.New("reconnect canceled")
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+
+		c.Close()
+		err := c.connect(ctx)
+		if err == nil {
+			return nil
+		}
+
+		delay *= 2
+		if delay > maxReconnectDelay {
+			delay = maxReconnectDelay
+		}
+	}
+
+	return errors.Errorf("reconnect to %s failed after %d retries", c.node.Host, maxRetries)
+}
+
+func (c *defaultClient) setReconnecting(b bool) {
+	c.reconnecting = b
+	if c.jump != nil {
+		c.jump.reconnecting = b
+	}
+}
+
+func (c *defaultClient) cachedAnswers(questions []string) ([]string, bool) {
+	answers := make([]string, 0, len(questions))
+	for _, q := range questions {
+		a, ok := c.answers[q]
+		if !ok {
+			return nil, false
+		}
+		answers = append(answers, a)
+	}
+	return answers, true
+}
+
+// stdinRelay forwards the local stdin to the stdin of the current session.
+// os.Stdin can only be read by one goroutine, so the relay outlives sessions
+// and is attached to the new one after a reconnect.
+type stdinRelay struct {
+	mu      sync.Mutex
+	w       io.Writer
+	session io.Closer
+	eof     bool
+	intr    chan struct{}
+}
+
+func newStdinRelay() *stdinRelay {
+	return &stdinRelay{
+		intr: make(chan struct{}, 1),
+	}
+}
+
+func (r *stdinRelay) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	w := r.w
+	r.mu.Unlock()
+
+	if w == nil {
+		// not connected, only watch for Ctrl-C
+		if bytes.IndexByte(p, 0x03) >= 0 {
+			select {
+			case r.intr <- struct{}{}:
+			default:
+			}
+		}
+		return len(p), nil
+	}
+
+	// the session may be gone already, errors are reported by session.Wait
+	w.Write(p)
+	return len(p), nil
+}
+
+// Close marks the local stdin as finished and closes the current session.
+func (r *stdinRelay) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.eof = true
+	if r.session != nil {
+		return r.session.Close()
+	}
+	return nil
+}
+
+func (r *stdinRelay) attach(w io.Writer, session io.Closer) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.w = w
+	r.session = session
+	if r.eof {
+		session.Close()
+	}
+}
+
+func (r *stdinRelay) detach() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.w = nil
+	r.session = nil
+
+	// drop a Ctrl-C typed into the previous session
+	select {
+	case <-r.intr:
+	default:
+	}
+}
+
+func (r *stdinRelay) closed() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.eof
+}
+
+func (r *stdinRelay) interrupted() <-chan struct{} {
+	return r.intr
+}
@@ -0,0 +1,121 @@
+package sshw
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/sys/unix"
+)
+
+// openPty returns the master and the slave of a new pseudo terminal.
+func openPty(t *testing.T) (*os.File, *os.File) {
+	m, err := os.OpenFile("/dev/ptmx", os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		t.Skip("no pty:", err)
+	}
+	t.Cleanup(func() { m.Close() })
+
+	n, err := unix.IoctlGetInt(int(m.Fd()), unix.TIOCGPTN)
+	assert.Nil(t, err)
+	assert.Nil(t, unix.IoctlSetPointerInt(int(m.Fd()), unix.TIOCSPTLCK, 0))
+	s, err := os.OpenFile(fmt.Sprintf("/dev/pts/%d", n), os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		t.Skip("no pty:", err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return m, s
+}
+
+func TestLoginReconnect(t *testing.T) {
+	var (
+		mu        sync.Mutex
+		conns     int
+		ptys      int
+		callbacks int
+	)
+
+	// a shell that drops the first connection once the callback arrived, and
+	// exits on the second one
+	node := newTestServerFunc(t, func(conn net.Conn, config *ssh.ServerConfig) {
+		sconn, chans, reqs, err := ssh.NewServerConn(conn, config)
+		if err != nil {
+			conn.Close()
+			return
+		}
+		defer sconn.Close()
+		go ssh.DiscardRequests(reqs)
+
+		mu.Lock()
+		conns++
+		first := conns == 1
+		mu.Unlock()
+
+		for nc := range chans {
+			ch, chReqs, err := nc.Accept()
+			if err != nil {
+				continue
+			}
+			go func() {
+				for req := range chReqs {
+					if req.Type == "pty-req" {
+						mu.Lock()
+						ptys++
+						mu.Unlock()
+					}
+					req.Reply(req.Type == "pty-req" || req.Type == "shell" || req.Type == "env", nil)
+					if req.Type != "shell" {
+						continue
+					}
+
+					go func() {
+						ch.Write([]byte("\x1b[1mhost\x1b[0m $ "))
+						var input []byte
+						b := make([]byte, 256)
+						for !bytes.Contains(input, []byte("hello\r")) {
+							n, err := ch.Read(b)
+							if err != nil {
+								return
+							}
+							input = append(input, b[:n]...)
+						}
+
+						mu.Lock()
+						callbacks++
+						mu.Unlock()
+						if first {
+							sconn.Close()
+							return
+						}
+						ch.SendRequest("exit-status", false, binary.BigEndian.AppendUint32(nil, 0))
+						ch.Close()
+					}()
+				}
+			}()
+		}
+	})
+	node.Reconnect = &ReconnectOption{MaxRetries: 3}
+	node.CallbackShells = []*CallbackShell{{Expect: `host \$`, Cmd: "hello"}}
+
+	_, slave := openPty(t)
+	stdin := os.Stdin
+	os.Stdin = slave
+	defer func() { os.Stdin = stdin }()
+
+	err := NewClient(node).Login(context.Background())
+	assert.Nil(t, err)
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, 2, conns)
+	assert.Equal(t, 2, ptys)
+	assert.Equal(t, 2, callbacks)
+}
@@ -0,0 +1,27 @@
+package sshw
+
+import (
+	"context"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestConnectionDead(t *testing.T) {
+	node := newTestServer(t)
+
+	c := genSSHConfig(node)
+	assert.Nil(t, c.connect(context.Background()))
+
+	// a session that ends without an exit status leaves the connection alive
+	assert.True(t, isConnectionLost(&ssh.ExitMissingError{}))
+	assert.True(t, isConnectionLost(io.EOF))
+	assert.False(t, c.connectionDead())
+
+	// like after a keepalive failed
+	c.client.Close()
+	assert.True(t, c.connectionDead())
+	c.Close()
+}
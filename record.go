@@ -0,0 +1,237 @@
+package sshw
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/atrox/homedir"
+	"github.com/pkg/errors"
+)
+
+const defaultRecordDir = "~/.sshw.d/records"
+
+// castHeader is the first line of an asciicast v2 file.
+// see https://docs.asciinema.org/manual/asciicast/v2/
+type castHeader struct {
+	Version   int               `json:"version"`
+	Width     int               `json:"width"`
+	Height    int               `json:"height"`
+	Timestamp int64             `json:"timestamp"`
+	Title     string            `json:"title,omitempty"`
+	Env       map[string]string `json:"env,omitempty"`
+}
+
+// Recorder writes terminal output, and optionally input, to an asciicast v2 file.
+// All methods are safe to call on a nil Recorder, which records nothing.
+type Recorder struct {
+	mu      sync.Mutex
+	f       *os.File
+	w       *bufio.Writer
+	start   time.Time
+	pending map[string][]byte
+}
+
+// NewRecorder creates the cast file at path and writes its header.
+func NewRecorder(path string, width, height int, title string) (*Recorder, error) {
+	err := os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return nil, errors.Wrap(err, "create record dir fail")
+	}
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, errors.Wrap(err, "create record file fail")
+	}
+
+	r := &Recorder{
+		f:       f,
+		w:       bufio.NewWriter(f),
+		start:   time.Now(),
+		pending: make(map[string][]byte),
+	}
+
+	b, err := json.Marshal(castHeader{
+		Version:   2,
+		Width:     width,
+		Height:    height,
+		Timestamp: r.start.Unix(),
+		Title:     title,
+		Env: map[string]string{
+			"TERM":  os.Getenv("TERM"),
+			"SHELL": os.Getenv("SHELL"),
+		},
+	})
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	r.w.Write(append(b, '\n'))
+
+	return r, nil
+}
+
+// Output returns a writer recording "o" events.
+func (r *Recorder) Output() io.Writer {
+	if r == nil {
+		return io.Discard
+	}
+	return recordWriter{r, "o"}
+}
+
+// Input returns a writer recording "i" events.
+func (r *Recorder) Input() io.Writer {
+	if r == nil {
+		return io.Discard
+	}
+	return recordWriter{r, "i"}
+}
+
+// Resize records a terminal size change.
+func (r *Recorder) Resize(width, height int) {
+	if r == nil {
+		return
+	}
+	r.event("r", []byte(fmt.Sprintf("%dx%d", width, height)))
+}
+
+func (r *Recorder) Close() error {
+	if r == nil {
+		return nil
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	err := r.w.Flush()
+	if cerr := r.f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func (r *Recorder) event(kind string, p []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// keep a multi-byte rune split across writes for the next event
+	data := append(r.pending[kind], p...)
+	n := len(data)
+	for i := 1; i < utf8.UTFMax && i <= len(data); i++ {
+		if utf8.RuneStart(data[len(data)-i]) {
+			if !utf8.FullRune(data[len(data)-i:]) {
+				n = len(data) - i
+			}
+			break
+		}
+	}
+	r.pending[kind] = append([]byte(nil), data[n:]...)
+	if n == 0 {
+		return
+	}
+
+	b, err := json.Marshal([]interface{}{time.Since(r.start).Seconds(), kind, string(data[:n])})
+	if err != nil {
+		return
+	}
+	r.w.Write(append(b, '\n'))
+}
+
+type recordWriter struct {
+	r    *Recorder
+	kind string
+}
+
+func (w recordWriter) Write(p []byte) (int, error) {
+	w.r.event(w.kind, p)
+	return len(p), nil
+}
+
+func (o *RecordOption) path(n *Node, t time.Time) (string, error) {
+	dir := o.Dir
+	if dir == "" {
+		dir = defaultRecordDir
+	}
+	dir, err := homedir.Expand(dir)
+	if err != nil {
+		return "", err
+	}
+
+	name := strings.Map(func(r rune) rune {
+		if r == '/' || r == '\\' || r == ' ' || r == ':' {
+			return '_'
+		}
+		return r
+	}, n.Name)
+	if name == "" {
+		name = n.Host
+	}
+
+	return filepath.Join(dir, fmt.Sprintf("%s-%s.cast", name, t.Format("20060102-150405"))), nil
+}
+
+// Replay plays an asciicast v2 recording to w. speed scales the playback rate,
+// and pauses longer than maxIdle are shortened to maxIdle when it is positive.
+func Replay(r io.Reader, w io.Writer, speed float64, maxIdle time.Duration) error {
+	if speed <= 0 {
+		speed = 1
+	}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+
+	if !scanner.Scan() {
+		if err := scanner.Err(); err != nil {
+			return err
+		}
+		return errors.New("empty recording")
+	}
+
+	var header castHeader
+	err := json.Unmarshal(scanner.Bytes(), &header)
+	if err != nil {
+		return errors.Wrap(err, "parse header fail")
+	}
+	if header.Version != 2 {
+		return errors.Errorf("unsupported asciicast version : %d", header.Version)
+	}
+
+	var last float64
+	for scanner.Scan() {
+		var ev []interface{}
+		err = json.Unmarshal(scanner.Bytes(), &ev)
+		if err != nil || len(ev) != 3 {
+			return errors.Errorf("bad event : %s", scanner.Text())
+		}
+
+		at, _ := ev[0].(float64)
+		kind, _ := ev[1].(string)
+		data, _ := ev[2].(string)
+
+		if kind != "o" {
+			continue
+		}
+
+		delay := time.Duration((at - last) / speed * float64(time.Second))
+		if maxIdle > 0 && delay > maxIdle {
+			delay = maxIdle
+		}
+		last = at
+
+		time.Sleep(delay)
+
+		_, err = io.WriteString(w, data)
+		if err != nil {
+			return err
+		}
+	}
+
+	return scanner.Err()
+}
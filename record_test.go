@@ -0,0 +1,34 @@
+package sshw
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRecordReplay(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "test.cast")
+
+	r, err := NewRecorder(p, 80, 24, "test")
+	assert.Nil(t, err)
+
+	r.Output().Write([]byte("hello "))
+	r.Input().Write([]byte("ls\r"))
+	// a rune split across two writes
+	r.Output().Write([]byte("世界"[:4]))
+	r.Output().Write([]byte("世界"[4:]))
+	r.Resize(100, 30)
+	assert.Nil(t, r.Close())
+
+	f, err := os.Open(p)
+	assert.Nil(t, err)
+	defer f.Close()
+
+	out := &bytes.Buffer{}
+	err = Replay(f, out, 100, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, "hello 世界", out.String())
+}
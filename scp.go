@@ -2,22 +2,71 @@ package sshw
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/pkg/errors"
-	"github.com/schollz/progressbar/v3"
 	"golang.org/x/crypto/ssh"
 )
 
-func CopyFromRemote(ctx context.Context, s *ssh.Session, remotePath string, localPath string) error {
-	f, err := os.OpenFile(localPath, os.O_RDWR|os.O_CREATE, 0644)
+// CopyOption are the settings of copying a file.
+type CopyOption struct {
+	// Preserve keeps the mode and times of the file, like scp -p.
+	Preserve bool
+	// Limit is the bandwidth in bytes per second, 0 or less is unlimited.
+	Limit int64
+
+	// shared by the copies of ScpAll
+	progress *progress
+	limiter  *rateLimiter
+}
+
+// bar adds the transfer to the progress of the copy, which is a progress of
+// its own unless it is one of ScpAll. done finishes it with the error of the copy.
+func (o CopyOption) bar(desc string, size int64) (b *bar, done func(err error)) {
+	p := o.progress
+	if p == nil {
+		p = newProgress(os.Stdout)
+	}
+	b = p.add(desc, size)
+	return b, func(err error) {
+		b.finish(err)
+		if o.progress == nil {
+			p.close()
+		}
+	}
+}
+
+func (o CopyOption) rateLimiter() *rateLimiter {
+	if o.limiter != nil {
+		return o.limiter
+	}
+	return newRateLimiter(o.Limit)
+}
+
+// CopyFromRemote downloads remotePath to localPath. With Preserve its mode and
+// times are kept like scp -p, otherwise it is created 0644.
+func CopyFromRemote(ctx context.Context, s *ssh.Session, remotePath string, localPath string, opt CopyOption) error {
+	// download into a temp file next to the target, so an aborted copy leaves nothing behind
+	f, err := os.CreateTemp(filepath.Dir(localPath), "."+filepath.Base(localPath)+".*.part")
 	if err != nil {
 		return errors.Wrap(err, "open file fail")
 	}
+	defer func() {
+		f.Close()
+		os.Remove(f.Name())
+	}()
+
+	var infos *FileInfos
+	var times *FileTimes
 
 	wg := sync.WaitGroup{}
 	errCh := make(chan error, 1)
@@ -35,82 +84,127 @@ func CopyFromRemote(ctx context.Context, s *ssh.Session, remotePath string, loca
 
 		r, err := s.StdoutPipe()
 		if err != nil {
-			errCh <- err
 			return
 		}
 
 		in, err := s.StdinPipe()
 		if err != nil {
-			errCh <- err
 			return
 		}
 		defer in.Close()
 
-		err = s.Start(fmt.Sprintf("scp -f %q", remotePath))
+		flags := "-f"
+		if opt.Preserve {
+			flags = "-pf"
+		}
+		err = s.Start(fmt.Sprintf("scp %s %q", flags, remotePath))
 		if err != nil {
-			errCh <- err
 			return
 		}
 
 		err = Ack(in)
 		if err != nil {
-			errCh <- err
 			return
 		}
 
 		res, err := ParseResponse(r)
 		if err != nil {
-			errCh <- err
 			return
 		}
+		if res.IsTimes() {
+			times, err = res.ParseFileTimes()
+			if err != nil {
+				return
+			}
+			err = Ack(in)
+			if err != nil {
+				return
+			}
+			res, err = ParseResponse(r)
+			if err != nil {
+				return
+			}
+		}
 		if res.IsFailure() {
-			errCh <- errors.New(res.GetMessage())
+			err = errors.New(res.GetMessage())
 			return
 		}
 
-		infos, err := res.ParseFileInfos()
+		infos, err = res.ParseFileInfos()
 		if err != nil {
-			errCh <- err
 			return
 		}
 
 		err = Ack(in)
 		if err != nil {
-			errCh <- err
 			return
 		}
 
-		bar := getBar(infos.Size, "downloading : "+infos.Filename)
+		bar, done := opt.bar("downloading : "+infos.Filename, infos.Size)
+		defer func() { done(err) }()
 
-		_, err = CopyN(io.MultiWriter(f, bar), r, infos.Size)
+		_, err = CopyN(newRateWriter(ctx, io.MultiWriter(f, bar), opt.rateLimiter()), r, infos.Size)
 		if err != nil {
-			errCh <- err
 			return
 		}
 
 		err = Ack(in)
 		if err != nil {
-			errCh <- err
 			return
 		}
 
 		err = s.Wait()
-		if err != nil {
-			errCh <- err
-			return
-		}
 	}()
 
 	if err := wait(ctx, &wg); err != nil {
+		// closing the session unblocks the copy
+		s.Close()
 		return err
 	}
 	finalErr := <-errCh
 	close(errCh)
 
-	return finalErr
+	if finalErr != nil {
+		return finalErr
+	}
+
+	mode := os.FileMode(0644)
+	if opt.Preserve {
+		mode, err = infos.Mode()
+		if err != nil {
+			return errors.Wrap(err, "parse file mode fail")
+		}
+	}
+	return finishFile(f, localPath, mode, times)
+}
+
+// finishFile moves the downloaded temp file f to localPath with mode, and
+// times when they are not nil.
+func finishFile(f *os.File, localPath string, mode os.FileMode, times *FileTimes) error {
+	err := f.Chmod(mode)
+	if err != nil {
+		return errors.Wrap(err, "chmod file fail")
+	}
+
+	err = f.Close()
+	if err != nil {
+		return errors.Wrap(err, "close file fail")
+	}
+
+	if times != nil {
+		err = os.Chtimes(f.Name(), times.Atime, times.Mtime)
+		if err != nil {
+			return errors.Wrap(err, "change file times fail")
+		}
+	}
+
+	return errors.Wrap(os.Rename(f.Name(), localPath), "rename file fail")
 }
 
-func CopyFromLocal(ctx context.Context, s *ssh.Session, localPath string, remotePath string) error {
+// CopyFromLocal uploads localPath to remotePath with its mode. With Preserve
+// its times are kept too like scp -p, the modification time is sent as the
+// access time as well, as the latter can not be read portably.
+func CopyFromLocal(ctx context.Context, s *ssh.Session, localPath string, remotePath string, opt CopyOption) error {
 	info, err := os.Stat(localPath)
 	if err != nil {
 		return errors.Wrap(err, "get file fail")
@@ -143,7 +237,20 @@ func CopyFromLocal(ctx context.Context, s *ssh.Session, localPath string, remote
 
 		defer w.Close()
 
-		_, err = fmt.Fprintln(w, "C0644", info.Size(), filepath.Base(remotePath))
+		if opt.Preserve {
+			_, err = io.WriteString(w, TimesMessage(&FileTimes{Mtime: info.ModTime(), Atime: info.ModTime()}))
+			if err != nil {
+				errCh <- errors.Wrap(err, "write times fail")
+				return
+			}
+
+			if err = checkResponse(stdout); err != nil {
+				errCh <- errors.Wrap(err, "check times response fail")
+				return
+			}
+		}
+
+		_, err = fmt.Fprintf(w, "C%04o %d %s\n", info.Mode().Perm(), info.Size(), filepath.Base(remotePath))
 		if err != nil {
 			errCh <- errors.Wrap(err, "write command fail")
 			return
@@ -154,9 +261,10 @@ func CopyFromLocal(ctx context.Context, s *ssh.Session, localPath string, remote
 			return
 		}
 
-		bar := getBar(info.Size(), "uploading : "+info.Name())
+		bar, done := opt.bar("uploading : "+info.Name(), info.Size())
+		defer func() { done(err) }()
 
-		_, err = io.CopyN(io.MultiWriter(w, bar), f, info.Size())
+		_, err = io.CopyN(newRateWriter(ctx, io.MultiWriter(w, bar), opt.rateLimiter()), f, info.Size())
 		if err != nil {
 			errCh <- errors.Wrap(err, "copy fail")
 			return
@@ -176,7 +284,11 @@ func CopyFromLocal(ctx context.Context, s *ssh.Session, localPath string, remote
 
 	go func() {
 		defer wg.Done()
-		cmd := fmt.Sprintf("scp -vt %q", remotePath)
+		flags := "-vt"
+		if opt.Preserve {
+			flags = "-vpt"
+		}
+		cmd := fmt.Sprintf("scp %s %q", flags, remotePath)
 		err := s.Run(cmd)
 		if err != nil {
 			errCh <- errors.Wrap(err, "run scp fail")
@@ -185,6 +297,8 @@ func CopyFromLocal(ctx context.Context, s *ssh.Session, localPath string, remote
 	}()
 
 	if err := wait(ctx, &wg); err != nil {
+		// closing the session unblocks the copy
+		s.Close()
 		return errors.Wrap(err, "wait fail")
 	}
 
@@ -198,6 +312,22 @@ func CopyFromLocal(ctx context.Context, s *ssh.Session, localPath string, remote
 	return nil
 }
 
+// fileSha256 returns the hex sha256 of the file at p.
+func fileSha256(p string) (string, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return "", errors.Wrap(err, "open file fail")
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	_, err = io.Copy(h, f)
+	if err != nil {
+		return "", errors.Wrap(err, "read file fail")
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
 func checkResponse(r io.Reader) error {
 	response, err := ParseResponse(r)
 	if err != nil {
@@ -242,21 +372,109 @@ func CopyN(writer io.Writer, src io.Reader, size int64) (int64, error) {
 	return total, nil
 }
 
-func getBar(size int64, desc string) io.Writer {
-	bar := progressbar.NewOptions(int(size),
-		// progressbar.OptionSetWriter(ansi.NewAnsiStdout()),
-		progressbar.OptionEnableColorCodes(true),
-
-		progressbar.OptionShowBytes(true),
-		progressbar.OptionSetWidth(25),
-		progressbar.OptionSetDescription(desc),
-		progressbar.OptionSetTheme(progressbar.Theme{
-			Saucer:        "[green]=[reset]",
-			SaucerHead:    "[green]>[reset]",
-			SaucerPadding: " ",
-			BarStart:      "[",
-			BarEnd:        "]",
-		}))
-
-	return bar
+// ParseRate parses a bandwidth like 5MB/s, 500k or 1.5MiB/s into bytes per
+// second. The units are powers of 1024, the B and /s are optional.
+func ParseRate(s string) (int64, error) {
+	t := strings.TrimSuffix(strings.ToLower(strings.TrimSpace(s)), "/s")
+	t = strings.TrimSuffix(strings.TrimSuffix(t, "b"), "i")
+
+	unit := 1.0
+	if n := len(t); n > 0 {
+		switch t[n-1] {
+		case 'k':
+			unit = 1 << 10
+		case 'm':
+			unit = 1 << 20
+		case 'g':
+			unit = 1 << 30
+		}
+		if unit > 1 {
+			t = t[:n-1]
+		}
+	}
+
+	v, err := strconv.ParseFloat(t, 64)
+	if err != nil || v < 0 {
+		return 0, errors.Errorf("invalid rate : %s", s)
+	}
+	return int64(v * unit), nil
+}
+
+// rateLimiter is a bandwidth shared by the copies of ScpAll. Like a token
+// bucket, time left unused is credited up to rateBurst, so that the rate is
+// still held after a stall.
+type rateLimiter struct {
+	rate int64
+
+	mu   sync.Mutex
+	next time.Time
+}
+
+const rateBurst = time.Second / 10
+
+// newRateLimiter returns nil when rate is unlimited.
+func newRateLimiter(rate int64) *rateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	return &rateLimiter{rate: rate, next: time.Now()}
+}
+
+// reserve counts n bytes and returns when they are due.
+func (l *rateLimiter) reserve(n int) time.Time {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if min := time.Now().Add(-rateBurst); l.next.Before(min) {
+		l.next = min
+	}
+	l.next = l.next.Add(time.Duration(float64(n) / float64(l.rate) * float64(time.Second)))
+	return l.next
+}
+
+// rateWriter writes to w within the bandwidth of l, it gives up waiting when
+// ctx is done.
+type rateWriter struct {
+	ctx context.Context
+	w   io.Writer
+	l   *rateLimiter
+}
+
+func newRateWriter(ctx context.Context, w io.Writer, l *rateLimiter) io.Writer {
+	if l == nil {
+		return w
+	}
+	return &rateWriter{ctx: ctx, w: w, l: l}
+}
+
+func (w *rateWriter) Write(b []byte) (int, error) {
+	// in chunks of a tenth of a second, so that the rate stays even
+	chunk := int(w.l.rate/10) + 1
+
+	var total int
+	for len(b) > 0 {
+		n := len(b)
+		if n > chunk {
+			n = chunk
+		}
+		n, err := w.w.Write(b[:n])
+		total += n
+		b = b[n:]
+		due := w.l.reserve(n)
+		if err != nil {
+			return total, err
+		}
+
+		// wait until the bytes written so far are due
+		if d := time.Until(due); d > 0 {
+			timer := time.NewTimer(d)
+			select {
+			case <-timer.C:
+			case <-w.ctx.Done():
+				timer.Stop()
+				return total, w.ctx.Err()
+			}
+		}
+	}
+	return total, nil
 }
@@ -1,10 +1,14 @@
 package sshw
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -67,9 +71,295 @@ func TestParsePath(t *testing.T) {
 
 		assert.Equal(t, v, p)
 	}
+
+	// ad-hoc targets with a port
+	hosts := map[string][2]string{
+		"root@10.0.0.5:2222:/tmp": {"root@10.0.0.5:2222", "/tmp"},
+		"10.0.0.5:2222:":          {"10.0.0.5:2222", "./"},
+		"dev:/a:b":                {"dev", "/a:b"},
+		"dev:22":                  {"dev", "./22"},
+		"[::1]:~/x":               {"[::1]", "~/x"},
+		"root@[::1]:2222:/tmp":    {"root@[::1]:2222", "/tmp"},
+	}
+	for k, v := range hosts {
+		h, p, err := ParseHostFile(k)
+		assert.Nil(t, err, k)
+		assert.Equal(t, v[0], h, k)
+		assert.Equal(t, v[1], p, k)
+	}
+
+	_, _, err := ParseHostFile("[::1]/tmp")
+	assert.NotNil(t, err)
+	assert.Equal(t, &Node{Name: "root@[::1]:2222", User: "root", Host: "::1", Port: 2222}, ParseTarget("root@[::1]:2222"))
 }
 
 func TestHistory(t *testing.T) {
 	v := os.Environ()
 	fmt.Println(v)
 }
+
+func TestScpRoundTrip(t *testing.T) {
+	node := newTestServer(t)
+	dir := t.TempDir()
+
+	src := filepath.Join(dir, "src.txt")
+	assert.Nil(t, os.WriteFile(src, []byte("hello sshw"), 0644))
+
+	err := NewClient(node).Scp(context.Background(), ScpOption{SrcFilePath: src, TarHost: "test", TarFilePath: filepath.Join(dir, "remote.txt")})
+	assert.Nil(t, err)
+
+	err = NewClient(node).Scp(context.Background(), ScpOption{SrcHost: "test", SrcFilePath: filepath.Join(dir, "remote.txt"), TarFilePath: filepath.Join(dir, "local.txt")})
+	assert.Nil(t, err)
+
+	b, err := os.ReadFile(filepath.Join(dir, "local.txt"))
+	assert.Nil(t, err)
+	assert.Equal(t, "hello sshw", string(b))
+}
+
+func TestScpCanceled(t *testing.T) {
+	node := newTestServer(t)
+	dir := t.TempDir()
+
+	c := genSSHConfig(node)
+	assert.Nil(t, c.connect(context.Background()))
+	defer c.Close()
+
+	s, err := c.client.NewSession()
+	assert.Nil(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	// a remote file that never ends
+	err = CopyFromRemote(ctx, s, "/dev/zero", filepath.Join(dir, "zero"), CopyOption{})
+	assert.Equal(t, context.Canceled, err)
+
+	entries, err := os.ReadDir(dir)
+	assert.Nil(t, err)
+	assert.Empty(t, entries)
+}
+
+func TestRemoveRemote(t *testing.T) {
+	node := newTestServer(t)
+	dir := t.TempDir()
+
+	c := genSSHConfig(node)
+	assert.Nil(t, c.connect(context.Background()))
+	defer c.Close()
+
+	// an upload into a directory left its partial file in it
+	up := filepath.Join(dir, "up")
+	assert.Nil(t, os.Mkdir(up, 0755))
+	assert.Nil(t, os.WriteFile(filepath.Join(up, "up"), []byte("part"), 0644))
+	c.removeRemote(up)
+	_, err := os.Stat(filepath.Join(up, "up"))
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(up)
+	assert.Nil(t, err)
+
+	file := filepath.Join(dir, "file.txt")
+	assert.Nil(t, os.WriteFile(file, []byte("part"), 0644))
+	c.removeRemote(file)
+	_, err = os.Stat(file)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestScpVerify(t *testing.T) {
+	node := newTestServer(t)
+	dir := t.TempDir()
+
+	src := filepath.Join(dir, "src.txt")
+	assert.Nil(t, os.WriteFile(src, []byte("hello sshw"), 0644))
+	up := filepath.Join(dir, "up")
+	assert.Nil(t, os.Mkdir(up, 0755))
+
+	// into a directory
+	err := NewClient(node).Scp(context.Background(), ScpOption{SrcFilePath: src, TarHost: "test", TarFilePath: up, Verify: true})
+	assert.Nil(t, err)
+
+	err = NewClient(node).Scp(context.Background(), ScpOption{SrcHost: "test", SrcFilePath: src, TarFilePath: filepath.Join(dir, "down.txt"), Verify: true})
+	assert.Nil(t, err)
+
+	other := filepath.Join(dir, "other.txt")
+	assert.Nil(t, os.WriteFile(other, []byte("hello world"), 0644))
+
+	c := genSSHConfig(node)
+	assert.Nil(t, c.connect(context.Background()))
+	defer c.Close()
+	assert.ErrorIs(t, c.verify(src, other), ErrChecksumMismatch)
+	assert.NotNil(t, c.verify(src, filepath.Join(dir, "missing.txt")))
+}
+
+func TestScpPreserve(t *testing.T) {
+	node := newTestServer(t)
+	dir := t.TempDir()
+
+	src := filepath.Join(dir, "run.sh")
+	assert.Nil(t, os.WriteFile(src, []byte("#!/bin/sh\necho sshw\n"), 0644))
+	assert.Nil(t, os.Chmod(src, 0750))
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	assert.Nil(t, os.Chtimes(src, mtime, mtime))
+
+	remote := filepath.Join(dir, "remote.sh")
+	err := NewClient(node).Scp(context.Background(), ScpOption{SrcFilePath: src, TarHost: "test", TarFilePath: remote, CopyOption: CopyOption{Preserve: true}})
+	assert.Nil(t, err)
+
+	local := filepath.Join(dir, "local.sh")
+	err = NewClient(node).Scp(context.Background(), ScpOption{SrcHost: "test", SrcFilePath: remote, TarFilePath: local, CopyOption: CopyOption{Preserve: true}})
+	assert.Nil(t, err)
+
+	for _, p := range []string{remote, local} {
+		info, err := os.Stat(p)
+		assert.Nil(t, err)
+		assert.Equal(t, os.FileMode(0750), info.Mode().Perm(), p)
+		assert.True(t, mtime.Equal(info.ModTime()), p)
+	}
+}
+
+func TestParseFileTimes(t *testing.T) {
+	mtime := time.Unix(1577934245, 0)
+	msg := TimesMessage(&FileTimes{Mtime: mtime, Atime: mtime.Add(time.Hour)})
+	assert.Equal(t, "T1577934245 0 1577937845 0\n", msg)
+
+	res, err := ParseResponse(strings.NewReader(msg))
+	assert.Nil(t, err)
+	assert.True(t, res.IsTimes())
+	times, err := res.ParseFileTimes()
+	assert.Nil(t, err)
+	assert.Equal(t, mtime, times.Mtime)
+	assert.Equal(t, mtime.Add(time.Hour), times.Atime)
+
+	res, err = ParseResponse(strings.NewReader("C0755 12 run.sh\n"))
+	assert.Nil(t, err)
+	infos, err := res.ParseFileInfos()
+	assert.Nil(t, err)
+	mode, err := infos.Mode()
+	assert.Nil(t, err)
+	assert.Equal(t, os.FileMode(0755), mode)
+}
+
+func TestParseRate(t *testing.T) {
+	cases := map[string]int64{
+		"5MB/s":    5 << 20,
+		"500k":     500 << 10,
+		"1.5MiB/s": 3 << 19,
+		"1G":       1 << 30,
+		"2048":     2048,
+		"0":        0,
+	}
+	for s, want := range cases {
+		got, err := ParseRate(s)
+		assert.Nil(t, err, s)
+		assert.Equal(t, want, got, s)
+	}
+
+	for _, s := range []string{"", "fast", "-1MB/s", "5TB"} {
+		_, err := ParseRate(s)
+		assert.NotNil(t, err, s)
+	}
+}
+
+func TestRateWriter(t *testing.T) {
+	var b strings.Builder
+	w := newRateWriter(context.Background(), &b, newRateLimiter(10000))
+
+	start := time.Now()
+	n, err := w.Write(make([]byte, 3000))
+	assert.Nil(t, err)
+	assert.Equal(t, 3000, n)
+	assert.GreaterOrEqual(t, time.Since(start), 250*time.Millisecond)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = newRateWriter(ctx, &b, newRateLimiter(1000)).Write(make([]byte, 3000))
+	assert.Equal(t, context.Canceled, err)
+
+	// an idle time is no credit for a burst afterwards
+	l := newRateLimiter(10000)
+	time.Sleep(500 * time.Millisecond)
+	start = time.Now()
+	_, err = newRateWriter(context.Background(), &b, l).Write(make([]byte, 3000))
+	assert.Nil(t, err)
+	assert.GreaterOrEqual(t, time.Since(start), 150*time.Millisecond)
+}
+
+func TestParseScpOptions(t *testing.T) {
+	opts, err := ParseScpOptions([]string{"a.txt", "/tmp/b.txt", "dev:~/dir"})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(opts))
+	assert.Equal(t, "dev", opts[1].TarHost)
+	assert.Equal(t, "./dir/a.txt", opts[0].TarFilePath)
+	assert.Equal(t, "./dir/b.txt", opts[1].TarFilePath)
+
+	opts, err = ParseScpOptions([]string{"dev:/var/log/a.log", "dev:/var/log/b.log", "./logs"})
+	assert.Nil(t, err)
+	assert.Equal(t, "./logs/b.log", opts[1].TarFilePath)
+
+	_, err = ParseScpOptions([]string{"dev:/var/log/a.log", "prod:/var/log/b.log", "./logs"})
+	assert.NotNil(t, err)
+	_, err = ParseScpOptions([]string{"a/x.txt", "b/x.txt", "dev:~/"})
+	assert.NotNil(t, err)
+}
+
+func TestScpAll(t *testing.T) {
+	node := newTestServer(t)
+	dir := t.TempDir()
+	remote := filepath.Join(dir, "remote")
+	local := filepath.Join(dir, "local")
+	assert.Nil(t, os.Mkdir(remote, 0755))
+	assert.Nil(t, os.Mkdir(local, 0755))
+
+	var up, down []ScpOption
+	for i := 0; i < 5; i++ {
+		name := fmt.Sprintf("%d.txt", i)
+		src := filepath.Join(dir, name)
+		assert.Nil(t, os.WriteFile(src, []byte(strings.Repeat(name, 1000)), 0644))
+		up = append(up, ScpOption{SrcFilePath: src, TarHost: "test", TarFilePath: filepath.Join(remote, name)})
+		down = append(down, ScpOption{SrcHost: "test", SrcFilePath: filepath.Join(remote, name), TarFilePath: filepath.Join(local, name)})
+	}
+
+	c := NewClient(node)
+	assert.Nil(t, c.Connect(context.Background()))
+	defer c.Close()
+	assert.Nil(t, c.ScpAll(context.Background(), up, 3))
+	assert.Nil(t, c.ScpAll(context.Background(), down, 3))
+
+	for i := 0; i < 5; i++ {
+		name := fmt.Sprintf("%d.txt", i)
+		b, err := os.ReadFile(filepath.Join(local, name))
+		assert.Nil(t, err)
+		assert.Equal(t, strings.Repeat(name, 1000), string(b))
+	}
+
+	down[1].SrcFilePath = filepath.Join(remote, "missing.txt")
+	err := c.ScpAll(context.Background(), down, 3)
+	assert.EqualError(t, err, "copy 1 of 5 files fail")
+
+	// one bandwidth is shared by all
+	down[2].Limit = 1024
+	err = c.ScpAll(context.Background(), down, 3)
+	assert.EqualError(t, err, "the files of ScpAll must have the same limit")
+}
+
+func TestProgress(t *testing.T) {
+	f, err := os.Create(filepath.Join(t.TempDir(), "progress"))
+	assert.Nil(t, err)
+	defer f.Close()
+
+	p := newProgress(f)
+	a := p.add("a.txt", 2048)
+	b := p.add("b.txt", 1024)
+	a.Write(make([]byte, 2048))
+	a.finish(nil)
+	b.Write(make([]byte, 100))
+	b.finish(errors.New("broken pipe"))
+	p.close()
+
+	out, err := os.ReadFile(f.Name())
+	assert.Nil(t, err)
+	lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+	assert.Equal(t, 3, len(lines))
+	assert.Regexp(t, `^a\.txt \[=+\] 100% \(2\.0 kB/2\.0 kB, .*/s\)$`, lines[0])
+	assert.Regexp(t, `^b\.txt \[==> +\]   9% \(failed\)$`, lines[1])
+	assert.Regexp(t, `^total 2/2 files \[.*]  69% \(2\.1 kB/3\.0 kB, .*/s\)$`, lines[2])
+}
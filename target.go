@@ -0,0 +1,228 @@
+package sshw
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+)
+
+// ParseTarget parses [user@]host[:port] into a node named after it.
+func ParseTarget(s string) *Node {
+	n := &Node{Name: s}
+	if i := strings.LastIndex(s, "@"); i >= 0 {
+		n.User, s = s[:i], s[i+1:]
+	}
+	if host, port, err := net.SplitHostPort(s); err == nil {
+		n.Host = host
+		n.Port, _ = strconv.Atoi(port)
+	} else {
+		n.Host = strings.Trim(s, "[]")
+	}
+	return n
+}
+
+// Target returns the node of the config for target, see Lookup. A target not
+// in the config is [user@]host[:port], its node takes the settings of the
+// first pattern node matching the host, like the Host patterns of ssh_config.
+//
+// The host of a node whose name is a pattern, e.g. "web-*", is a template:
+// its wildcards are replaced by what the ones of the name matched, in order,
+// and %h by the whole host, so "web-17" connects to "10.20.0.17" with the host
+// "10.20.0.*". Without a host, the target is the host. A node whose host is a
+// pattern, e.g. "*.internal", matches hosts themselves.
+func (c *Config) Target(target string) *Node {
+	if node := c.Lookup(target); node != nil {
+		return node
+	}
+
+	t := ParseTarget(target)
+	pattern, host := c.pattern(t.Host)
+	if pattern == nil {
+		t.Proxy = c.Proxy
+		return t
+	}
+
+	n := *pattern
+	n.Name, n.Alias, n.Host = t.Name, "", host
+	n.Children = nil
+	if t.User != "" {
+		n.User = t.User
+	}
+	if t.Port > 0 {
+		n.Port = t.Port
+	}
+	return &n
+}
+
+// Pattern returns the pattern node a target not in the config takes its
+// settings from, nil when none matches it.
+func (c *Config) Pattern(target string) *Node {
+	if c.Lookup(target) != nil {
+		return nil
+	}
+	pattern, _ := c.pattern(ParseTarget(target).Host)
+	return pattern
+}
+
+// pattern returns the first pattern node matching host and the host to connect to.
+func (c *Config) pattern(host string) (*Node, string) {
+	var expanded string
+	pattern := c.find(func(n *Node) bool {
+		var ok bool
+		expanded, ok = n.expand(host)
+		return ok
+	})
+	return pattern, expanded
+}
+
+// IsPattern reports whether the node is a template for other hosts rather than a host.
+func (n *Node) IsPattern() bool {
+	return len(n.Children) == 0 && (isPattern(n.Name) || isPattern(n.Host))
+}
+
+// expand returns the host to connect to for host when the node is a pattern matching it.
+func (n *Node) expand(host string) (string, bool) {
+	if len(n.Children) > 0 {
+		return "", false
+	}
+
+	if isPattern(n.Name) {
+		if captures, ok := capture(n.Name, host); ok {
+			if n.Host == "" {
+				return host, true
+			}
+
+			expanded := strings.ReplaceAll(n.Host, "%h", host)
+			for _, c := range captures {
+				i := strings.IndexAny(expanded, "*?")
+				if i < 0 {
+					break
+				}
+				expanded = expanded[:i] + c + expanded[i+1:]
+			}
+			if !isPattern(expanded) {
+				return expanded, true
+			}
+		}
+	}
+
+	if isPattern(n.Host) {
+		if _, ok := capture(n.Host, host); ok {
+			return host, true
+		}
+	}
+	return "", false
+}
+
+func isPattern(s string) bool {
+	return strings.ContainsAny(s, "*?")
+}
+
+// capture matches s against a pattern of * and ?, and returns what each of
+// them matched.
+func capture(pattern, s string) ([]string, bool) {
+	if pattern == "" {
+		return nil, s == ""
+	}
+
+	switch pattern[0] {
+	case '*':
+		for i := 0; i <= len(s); i++ {
+			if rest, ok := capture(pattern[1:], s[i:]); ok {
+				return append([]string{s[:i]}, rest...), true
+			}
+		}
+		return nil, false
+	case '?':
+		_, size := utf8.DecodeRuneInString(s)
+		if size == 0 {
+			return nil, false
+		}
+		if rest, ok := capture(pattern[1:], s[size:]); ok {
+			return append([]string{s[:size]}, rest...), true
+		}
+		return nil, false
+	}
+
+	if s == "" || s[0] != pattern[0] {
+		return nil, false
+	}
+	return capture(pattern[1:], s[1:])
+}
+
+// AppendNode adds the name, host, user and port of node to the end of the config
+// at p, keeping the rest of the file as it is. The nodes of a config with
+// settings must be its last key.
+func AppendNode(p string, node *Node) error {
+	b, err := ioutil.ReadFile(p)
+	if err != nil {
+		return err
+	}
+
+	indent := ""
+	var nodes []*Node
+	if yaml.Unmarshal(b, &nodes) != nil {
+		indent, err = nodesIndent(string(b))
+		if err != nil {
+			return err
+		}
+	}
+
+	fields := []string{"name: " + yamlScalar(node.Name), "host: " + yamlScalar(node.Host)}
+	if node.User != "" {
+		fields = append(fields, "user: "+yamlScalar(node.User))
+	}
+	if node.Port > 0 {
+		fields = append(fields, "port: "+strconv.Itoa(node.Port))
+	}
+	entry := indent + "- { " + strings.Join(fields, ", ") + " }\n"
+	if len(b) > 0 && b[len(b)-1] != '\n' {
+		entry = "\n" + entry
+	}
+
+	f, err := os.OpenFile(p, os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = f.WriteString(entry)
+	return err
+}
+
+// nodesIndent returns the indent of the items under the last key "nodes".
+func nodesIndent(config string) (string, error) {
+	lines := strings.Split(config, "\n")
+	last := -1
+	for i, line := range lines {
+		if line != "" && line[0] != ' ' && line[0] != '#' && line[0] != '-' {
+			last = i
+		}
+	}
+	if last < 0 || !strings.HasPrefix(lines[last], "nodes:") {
+		return "", errors.New("nodes is not the last key of the config")
+	}
+
+	for _, line := range lines[last+1:] {
+		trimmed := strings.TrimLeft(line, " ")
+		if strings.HasPrefix(trimmed, "-") {
+			return line[:len(line)-len(trimmed)], nil
+		}
+	}
+	return "  ", nil
+}
+
+// yamlScalar quotes s when it can not be a plain scalar of a flow mapping.
+func yamlScalar(s string) string {
+	b, _ := yaml.Marshal(s)
+	if string(b) != s+"\n" || strings.ContainsAny(s, ",[]{}") {
+		return strconv.Quote(s)
+	}
+	return s
+}
@@ -0,0 +1,95 @@
+package sshw
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTarget(t *testing.T) {
+	c, err := ParseConfig([]byte(`
+- { name: dev, host: 192.168.8.35 }
+- name: internal
+  user: ops
+  keypath: ~/.ssh/internal
+  jump: [{ host: bastion.example.com }]
+  host: "*.internal"
+`))
+	assert.Nil(t, err)
+
+	assert.Equal(t, "dev", c.Target("dev").Name)
+
+	n := c.Target("root@db.internal:2222")
+	assert.Equal(t, "db.internal", n.Host)
+	assert.Equal(t, "root", n.User)
+	assert.Equal(t, 2222, n.Port)
+	assert.Equal(t, "~/.ssh/internal", n.KeyPath)
+	assert.Equal(t, "bastion.example.com", n.Jump[0].Host)
+
+	n = c.Target("example.com")
+	assert.Equal(t, &Node{Name: "example.com", Host: "example.com"}, n)
+
+	assert.Equal(t, "internal", c.Pattern("root@db.internal:2222").Name)
+	assert.Nil(t, c.Pattern("example.com"))
+	assert.Nil(t, c.Pattern("dev"))
+
+	assert.Equal(t, &Node{Name: "[::1]:22", Host: "::1", Port: 22}, ParseTarget("[::1]:22"))
+
+	// patterns are no hosts to pick
+	assert.Len(t, c.Hosts(), 1)
+}
+
+func TestAppendNode(t *testing.T) {
+	dir := t.TempDir()
+	node := &Node{Name: "web, new", Host: "10.0.0.1", User: "root", Port: 2222}
+
+	p := filepath.Join(dir, "list")
+	assert.Nil(t, os.WriteFile(p, []byte("- { name: dev, host: 192.168.8.35 }"), 0600))
+	assert.Nil(t, AppendNode(p, node))
+	b, _ := os.ReadFile(p)
+	c, err := ParseConfig(b)
+	assert.Nil(t, err)
+	assert.Equal(t, "10.0.0.1", c.Lookup("web, new").Host)
+
+	p = filepath.Join(dir, "settings")
+	assert.Nil(t, os.WriteFile(p, []byte("disable-history: true\nnodes:\n  - { name: dev, host: 192.168.8.35 }\n"), 0600))
+	assert.Nil(t, AppendNode(p, node))
+	b, _ = os.ReadFile(p)
+	c, err = ParseConfig(b)
+	assert.Nil(t, err)
+	assert.Equal(t, 2222, c.Lookup("web, new").Port)
+	assert.True(t, c.DisableHistory)
+
+	p = filepath.Join(dir, "nodes first")
+	assert.Nil(t, os.WriteFile(p, []byte("nodes:\n- { name: dev, host: 192.168.8.35 }\ndisable-history: true\n"), 0600))
+	assert.NotNil(t, AppendNode(p, node))
+}
+
+func TestTargetNamePattern(t *testing.T) {
+	c, err := ParseConfig([]byte(`
+- { name: web-1, host: 10.20.0.100 }
+- { name: "web-*", host: "10.20.0.*", user: www, keypath: ~/.ssh/web }
+- { name: "db-?-*", host: "db*.dc?.internal" }
+- { name: "cache-*", host: "%h.example.com" }
+- { name: "gw-*" }
+`))
+	assert.Nil(t, err)
+
+	assert.Equal(t, "10.20.0.100", c.Target("web-1").Host)
+
+	n := c.Target("root@web-17")
+	assert.Equal(t, "root@web-17", n.Name)
+	assert.Equal(t, "10.20.0.17", n.Host)
+	assert.Equal(t, "root", n.User)
+	assert.Equal(t, "~/.ssh/web", n.KeyPath)
+
+	assert.Equal(t, "db3.dc12.internal", c.Target("db-3-12").Host)
+	assert.Equal(t, "cache-a.example.com", c.Target("cache-a").Host)
+	assert.Equal(t, "gw-eu", c.Target("gw-eu").Host)
+	assert.Equal(t, &Node{Name: "api-1", Host: "api-1"}, c.Target("api-1"))
+
+	assert.True(t, c.Lookup("web-*").IsPattern())
+	assert.Len(t, c.Select(""), 1)
+}
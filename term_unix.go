@@ -0,0 +1,165 @@
+//go:build unix
+
+package sshw
+
+import (
+	"io"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/sys/unix"
+)
+
+// stdinInterruptible tells whether a stdinReader returns promptly once done is closed.
+const stdinInterruptible = true
+
+// watchResize emits on every SIGWINCH until done is closed.
+func watchResize(done <-chan struct{}) <-chan struct{} {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGWINCH)
+
+	ch := make(chan struct{}, 1)
+	go func() {
+		defer signal.Stop(sigs)
+		for {
+			select {
+			case <-done:
+				return
+			case <-sigs:
+				select {
+				case ch <- struct{}{}:
+				default:
+				}
+			}
+		}
+	}()
+
+	return ch
+}
+
+// stdinReader reads f until done is closed, then returns io.EOF. It polls
+// before every read so that no goroutine is left blocked on the terminal.
+type stdinReader struct {
+	f    *os.File
+	done <-chan struct{}
+}
+
+func newStdinReader(f *os.File, done <-chan struct{}) io.Reader {
+	return &stdinReader{f: f, done: done}
+}
+
+func (r *stdinReader) Read(p []byte) (int, error) {
+	fds := []unix.PollFd{{Fd: int32(r.f.Fd()), Events: unix.POLLIN}}
+	for {
+		select {
+		case <-r.done:
+			return 0, io.EOF
+		default:
+		}
+
+		n, err := unix.Poll(fds, 100)
+		if err == unix.EINTR {
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		if n > 0 {
+			return r.f.Read(p)
+		}
+	}
+}
+
+// terminalModes copies the local termios settings of fd, it must be called
+// before the terminal is put into raw mode.
+func terminalModes(fd int) ssh.TerminalModes {
+	modes := defaultTerminalModes()
+
+	t, err := unix.IoctlGetTermios(fd, ioctlReadTermios)
+	if err != nil {
+		return modes
+	}
+
+	for op, i := range map[uint8]int{
+		ssh.VINTR:    unix.VINTR,
+		ssh.VQUIT:    unix.VQUIT,
+		ssh.VERASE:   unix.VERASE,
+		ssh.VKILL:    unix.VKILL,
+		ssh.VEOF:     unix.VEOF,
+		ssh.VEOL:     unix.VEOL,
+		ssh.VEOL2:    unix.VEOL2,
+		ssh.VSTART:   unix.VSTART,
+		ssh.VSTOP:    unix.VSTOP,
+		ssh.VSUSP:    unix.VSUSP,
+		ssh.VREPRINT: unix.VREPRINT,
+		ssh.VWERASE:  unix.VWERASE,
+		ssh.VLNEXT:   unix.VLNEXT,
+		ssh.VDISCARD: unix.VDISCARD,
+	} {
+		modes[op] = uint32(t.Cc[i])
+	}
+
+	flags := func(v uint64, m map[uint8]uint64) {
+		for op, bit := range m {
+			if v&bit != 0 {
+				modes[op] = 1
+			} else {
+				modes[op] = 0
+			}
+		}
+	}
+
+	flags(uint64(t.Iflag), map[uint8]uint64{
+		ssh.IGNPAR:  unix.IGNPAR,
+		ssh.PARMRK:  unix.PARMRK,
+		ssh.INPCK:   unix.INPCK,
+		ssh.ISTRIP:  unix.ISTRIP,
+		ssh.INLCR:   unix.INLCR,
+		ssh.IGNCR:   unix.IGNCR,
+		ssh.ICRNL:   unix.ICRNL,
+		ssh.IXON:    unix.IXON,
+		ssh.IXANY:   unix.IXANY,
+		ssh.IXOFF:   unix.IXOFF,
+		ssh.IMAXBEL: unix.IMAXBEL,
+	})
+	flags(uint64(t.Lflag), map[uint8]uint64{
+		ssh.ISIG:    unix.ISIG,
+		ssh.ICANON:  unix.ICANON,
+		ssh.ECHO:    unix.ECHO,
+		ssh.ECHOE:   unix.ECHOE,
+		ssh.ECHOK:   unix.ECHOK,
+		ssh.ECHONL:  unix.ECHONL,
+		ssh.NOFLSH:  unix.NOFLSH,
+		ssh.TOSTOP:  unix.TOSTOP,
+		ssh.IEXTEN:  unix.IEXTEN,
+		ssh.ECHOCTL: unix.ECHOCTL,
+		ssh.ECHOKE:  unix.ECHOKE,
+		ssh.PENDIN:  unix.PENDIN,
+	})
+	flags(uint64(t.Oflag), map[uint8]uint64{
+		ssh.OPOST:  unix.OPOST,
+		ssh.ONLCR:  unix.ONLCR,
+		ssh.OCRNL:  unix.OCRNL,
+		ssh.ONOCR:  unix.ONOCR,
+		ssh.ONLRET: unix.ONLRET,
+	})
+	flags(uint64(t.Cflag), map[uint8]uint64{
+		ssh.PARENB: unix.PARENB,
+		ssh.PARODD: unix.PARODD,
+	})
+
+	if ispeed, ospeed := termiosSpeed(t); ispeed > 0 && ospeed > 0 {
+		modes[ssh.TTY_OP_ISPEED], modes[ssh.TTY_OP_OSPEED] = ispeed, ospeed
+	}
+
+	switch uint64(t.Cflag) & unix.CSIZE {
+	case unix.CS7:
+		modes[ssh.CS7], modes[ssh.CS8] = 1, 0
+	case unix.CS8:
+		modes[ssh.CS7], modes[ssh.CS8] = 0, 1
+	}
+
+	return modes
+}
@@ -0,0 +1,62 @@
+//go:build windows
+
+package sshw
+
+import (
+	"io"
+	"os"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// stdinInterruptible tells whether a stdinReader returns promptly once done is closed.
+const stdinInterruptible = false
+
+// watchResize polls for size changes until done is closed, windows has no SIGWINCH.
+func watchResize(done <-chan struct{}) <-chan struct{} {
+	ch := make(chan struct{}, 1)
+	go func() {
+		ticker := time.NewTicker(time.Millisecond * 500)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				select {
+				case ch <- struct{}{}:
+				default:
+				}
+			}
+		}
+	}()
+
+	return ch
+}
+
+// stdinReader stops returning input once done is closed. A console read can
+// not be interrupted on windows, so the last read may still block until a key
+// is pressed.
+type stdinReader struct {
+	f    *os.File
+	done <-chan struct{}
+}
+
+func newStdinReader(f *os.File, done <-chan struct{}) io.Reader {
+	return &stdinReader{f: f, done: done}
+}
+
+func (r *stdinReader) Read(p []byte) (int, error) {
+	select {
+	case <-r.done:
+		return 0, io.EOF
+	default:
+	}
+	return r.f.Read(p)
+}
+
+// terminalModes returns the default modes, there is no termios on windows.
+func terminalModes(fd int) ssh.TerminalModes {
+	return defaultTerminalModes()
+}
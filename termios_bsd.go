@@ -0,0 +1,12 @@
+//go:build darwin || dragonfly || freebsd || netbsd || openbsd
+
+package sshw
+
+import "golang.org/x/sys/unix"
+
+const ioctlReadTermios = unix.TIOCGETA
+
+// termiosSpeed returns the input and output baud rates of t.
+func termiosSpeed(t *unix.Termios) (uint32, uint32) {
+	return uint32(t.Ispeed), uint32(t.Ospeed)
+}
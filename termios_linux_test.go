@@ -0,0 +1,18 @@
+package sshw
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+)
+
+func TestTermiosSpeed(t *testing.T) {
+	ispeed, ospeed := termiosSpeed(&unix.Termios{Cflag: unix.B38400 | unix.CS8})
+	assert.Equal(t, uint32(38400), ispeed)
+	assert.Equal(t, uint32(38400), ospeed)
+
+	ispeed, ospeed = termiosSpeed(&unix.Termios{Cflag: unix.B9600 | unix.B115200<<unix.IBSHIFT})
+	assert.Equal(t, uint32(115200), ispeed)
+	assert.Equal(t, uint32(9600), ospeed)
+}
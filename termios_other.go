@@ -0,0 +1,12 @@
+//go:build aix || solaris || zos
+
+package sshw
+
+import "golang.org/x/sys/unix"
+
+const ioctlReadTermios = unix.TCGETS
+
+// termiosSpeed returns no baud rates, the defaults are sent instead.
+func termiosSpeed(t *unix.Termios) (uint32, uint32) {
+	return 0, 0
+}
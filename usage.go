@@ -0,0 +1,181 @@
+package sshw
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/atrox/homedir"
+	"github.com/pkg/errors"
+)
+
+const (
+	CommandLogin   = "login"
+	CommandScp     = "scp"
+	CommandExec    = "exec"
+	CommandForward = "forward"
+)
+
+// UsageEntry records one use of a node.
+type UsageEntry struct {
+	Time time.Time `json:"time"`
+	// Path is the node name with its groups, see Config.Path.
+	Path string `json:"path"`
+	// Command is what the node was used for, one of the Command constants.
+	Command  string        `json:"command,omitempty"`
+	Duration time.Duration `json:"duration,omitempty"`
+	// Status is the exit status of sshw, 255 for connection errors.
+	Status int `json:"status"`
+}
+
+// UsageFilter selects entries of the usage log, zero fields match everything.
+type UsageFilter struct {
+	// Path matches entries whose path contains it.
+	Path    string
+	Command string
+	Since   time.Time
+	Failed  bool
+}
+
+func (f UsageFilter) match(e UsageEntry) bool {
+	return strings.Contains(e.Path, f.Path) &&
+		(f.Command == "" || f.Command == e.Command) &&
+		!e.Time.Before(f.Since) &&
+		(!f.Failed || e.Status != 0)
+}
+
+// Usage is the history of the nodes sshw connected to, stored as json lines in ~/.sshw.d/usage.jsonl.
+type Usage struct {
+	path    string
+	Entries []UsageEntry
+
+	frecency map[string]float64
+}
+
+// LoadUsage reads the usage log, a missing log is empty.
+func LoadUsage() (*Usage, error) {
+	dir, err := homedir.Expand(dataDir)
+	if err != nil {
+		return nil, err
+	}
+	return LoadUsageFile(filepath.Join(dir, "usage.jsonl"))
+}
+
+// LoadUsageFile reads the usage log at p.
+func LoadUsageFile(p string) (*Usage, error) {
+	u := &Usage{path: p}
+
+	f, err := os.Open(p)
+	if os.IsNotExist(err) {
+		return u, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var e UsageEntry
+		// skip lines that are broken, e.g. by a crash while writing
+		if json.Unmarshal(scanner.Bytes(), &e) == nil {
+			u.Entries = append(u.Entries, e)
+		}
+	}
+
+	return u, scanner.Err()
+}
+
+// Add appends an entry to the log.
+func (u *Usage) Add(e UsageEntry) error {
+	err := os.MkdirAll(filepath.Dir(u.path), 0700)
+	if err != nil {
+		return err
+	}
+
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(u.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return errors.Wrap(err, "open usage fail")
+	}
+	defer f.Close()
+
+	_, err = f.Write(append(b, '\n'))
+	if err != nil {
+		return errors.Wrap(err, "write usage fail")
+	}
+
+	u.Entries = append(u.Entries, e)
+	u.frecency = nil
+	return nil
+}
+
+// Filter returns the entries matching f, oldest first.
+func (u *Usage) Filter(f UsageFilter) []UsageEntry {
+	var entries []UsageEntry
+	for _, e := range u.Entries {
+		if f.match(e) {
+			entries = append(entries, e)
+		}
+	}
+	return entries
+}
+
+// Last returns the most recent entry, false when the log is empty.
+func (u *Usage) Last() (UsageEntry, bool) {
+	if len(u.Entries) == 0 {
+		return UsageEntry{}, false
+	}
+	return u.Entries[len(u.Entries)-1], true
+}
+
+// Recent returns up to n distinct paths, most recently used first.
+func (u *Usage) Recent(n int) []string {
+	var paths []string
+	seen := make(map[string]bool)
+	for i := len(u.Entries) - 1; i >= 0 && len(paths) < n; i-- {
+		p := u.Entries[i].Path
+		if !seen[p] {
+			seen[p] = true
+			paths = append(paths, p)
+		}
+	}
+	return paths
+}
+
+// Frecency scores how often and how recently the node at path was used.
+func (u *Usage) Frecency(path string) float64 {
+	if u == nil {
+		return 0
+	}
+
+	if u.frecency == nil {
+		u.frecency = make(map[string]float64)
+		now := time.Now()
+		for _, e := range u.Entries {
+			u.frecency[e.Path] += frecencyWeight(now.Sub(e.Time))
+		}
+	}
+	return u.frecency[path]
+}
+
+func frecencyWeight(age time.Duration) float64 {
+	switch {
+	case age < time.Hour:
+		return 4
+	case age < time.Hour*24:
+		return 2
+	case age < time.Hour*24*7:
+		return 1
+	case age < time.Hour*24*30:
+		return 0.5
+	}
+	return 0.25
+}
@@ -0,0 +1,37 @@
+package sshw
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUsageFilter(t *testing.T) {
+	u, err := LoadUsageFile(filepath.Join(t.TempDir(), "usage.jsonl"))
+	assert.Nil(t, err)
+
+	_, ok := u.Last()
+	assert.False(t, ok)
+
+	now := time.Now()
+	for _, e := range []UsageEntry{
+		{Time: now.Add(-48 * time.Hour), Path: "group / db", Command: CommandLogin},
+		{Time: now.Add(-time.Hour), Path: "dev", Command: CommandScp, Status: 1},
+		{Time: now, Path: "group / db", Command: CommandLogin, Duration: time.Minute},
+	} {
+		assert.Nil(t, u.Add(e))
+	}
+
+	last, ok := u.Last()
+	assert.True(t, ok)
+	assert.Equal(t, time.Minute, last.Duration)
+	assert.Equal(t, []string{"group / db", "dev"}, u.Recent(5))
+	assert.Equal(t, []string{"group / db"}, u.Recent(1))
+
+	assert.Len(t, u.Filter(UsageFilter{Path: "db"}), 2)
+	assert.Len(t, u.Filter(UsageFilter{Command: CommandScp}), 1)
+	assert.Len(t, u.Filter(UsageFilter{Failed: true}), 1)
+	assert.Len(t, u.Filter(UsageFilter{Since: now.Add(-24 * time.Hour)}), 2)
+}